@@ -1,7 +1,13 @@
 package interactionsCmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	fssync "github.com/tanq16/nits/internal/interactions/fs-sync"
@@ -9,95 +15,209 @@ import (
 )
 
 var fsSyncServeFlags struct {
-	mode      string
-	port      int
+	mode       string
+	port       int
+	dir        string
+	ignore     string
+	gitignore  bool
+	enableTLS  bool
+	delete     bool
+	dryRun     bool
+	rehash     bool
+	code       string
+	noAuth     bool
+	certFile   string
+	keyFile    string
+	watch      bool
+	noMDNS     bool
+	report     string
+	backupDir  string
+	noBackup   bool
+	maxClients int
+	timeout    time.Duration
+	filter     fsSyncFilterFlags
+}
+
+var fsSyncClientFlags struct {
+	dir         string
+	ignore      string
+	gitignore   bool
+	insecure    bool
+	delete      bool
+	dryRun      bool
+	delta       bool
+	rehash      bool
+	code        string
+	fingerprint string
+	watch       bool
+	noCompress  bool
+	parallel    int
+	bwLimit     string
+	report      string
+	backupDir   string
+	noBackup    bool
+	remotePath  string
+	filter      fsSyncFilterFlags
+}
+
+// fsSyncFilterFlags are the selectors shared by serve and client.
+type fsSyncFilterFlags struct {
+	include   string
+	minSize   string
+	maxSize   string
+	newerThan string
+	olderThan string
+}
+
+var fsSyncExportFlags struct {
+	dir          string
+	output       string
+	against      string
+	manifestOnly bool
+	ignore       string
+	gitignore    bool
+	dryRun       bool
+	rehash       bool
+	report       string
+	filter       fsSyncFilterFlags
+}
+
+var fsSyncImportFlags struct {
 	dir       string
 	ignore    string
-	enableTLS bool
+	gitignore bool
 	delete    bool
 	dryRun    bool
+	rehash    bool
+	report    string
+	backupDir string
+	noBackup  bool
+	filter    fsSyncFilterFlags
 }
 
-var fsSyncClientFlags struct {
-	dir      string
-	ignore   string
-	insecure bool
-	delete   bool
-	dryRun   bool
+var fsSyncRestoreFlags struct {
+	dir       string
+	backupDir string
+	list      bool
 }
 
 var FSSyncCmd = &cobra.Command{
 	Use:   "fs-sync",
-	Short: "One-shot bidirectional file synchronization over HTTP/HTTPS",
+	Short: "Bidirectional file synchronization over HTTP/HTTPS (one-shot or watch)",
 }
 
 var fsSyncServeCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start an HTTP server for file sync (use --mode to set direction)",
 	Run: func(cmd *cobra.Command, args []string) {
-		if fsSyncServeFlags.mode != "send" && fsSyncServeFlags.mode != "receive" {
-			u.PrintFatal("--mode must be 'send' or 'receive'", nil)
+		if fsSyncServeFlags.mode != "send" && fsSyncServeFlags.mode != "receive" && fsSyncServeFlags.mode != "both" {
+			u.PrintFatal("--mode must be 'send', 'receive' or 'both'", nil)
 		}
 		protocol := "http"
 		if fsSyncServeFlags.enableTLS {
 			protocol = "https"
 		}
+		code := fsSyncServeFlags.code
+		if !fsSyncServeFlags.noAuth && code == "" {
+			var err error
+			if code, err = fssync.GeneratePairingCode(); err != nil {
+				u.PrintFatal("Failed to generate pairing code", err)
+			}
+		}
 		u.PrintInfo(fmt.Sprintf("Starting fs-sync server (mode: %s): %s://localhost:%d directory=%s", fsSyncServeFlags.mode, protocol, fsSyncServeFlags.port, fsSyncServeFlags.dir))
+		if code != "" {
+			u.PrintInfo(fmt.Sprintf("Pairing code: %s", code))
+		} else {
+			u.PrintWarn("Authentication disabled: anyone who can reach this port can sync", nil)
+		}
 		cfg := fssync.ServerConfig{
 			Port:        fsSyncServeFlags.port,
 			SyncDir:     fsSyncServeFlags.dir,
 			IgnorePaths: fsSyncServeFlags.ignore,
+			Gitignore:   fsSyncServeFlags.gitignore,
 			EnableTLS:   fsSyncServeFlags.enableTLS,
 			Mode:        fsSyncServeFlags.mode,
 			DeleteExtra: fsSyncServeFlags.delete,
 			DryRun:      fsSyncServeFlags.dryRun,
+			Rehash:      fsSyncServeFlags.rehash,
+			PairingCode: code,
+			CertFile:    fsSyncServeFlags.certFile,
+			KeyFile:     fsSyncServeFlags.keyFile,
+			Watch:       fsSyncServeFlags.watch,
+			Advertise:   !fsSyncServeFlags.noMDNS,
+			BackupDir:   backupDir(fsSyncServeFlags.backupDir, fsSyncServeFlags.noBackup),
+			MaxClients:  fsSyncServeFlags.maxClients,
+			Timeout:     fsSyncServeFlags.timeout,
+			Filter:      fsSyncServeFlags.filter.parse(),
+			OnReport:    syncReporter(fsSyncServeFlags.report),
 		}
 		s, err := fssync.NewServer(cfg)
 		if err != nil {
 			u.PrintFatal("Failed to initialize server", err)
 		}
-		if err := s.Run(); err != nil {
+		if fp := s.Fingerprint(); fp != "" {
+			u.PrintInfo(fmt.Sprintf("TLS fingerprint (SHA-256): %s", fp))
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := s.Run(ctx); err != nil {
 			u.PrintFatal("Failed to run server", err)
 		}
 	},
 }
 
 var fsSyncClientCmd = &cobra.Command{
-	Use:   "client <server-url>",
+	Use:   "client [server-url]",
 	Short: "Connect to an fs-sync server and sync files (direction auto-detected)",
-	Args:  cobra.ExactArgs(1),
+	Long: `Connect to an fs-sync server and sync files; the direction follows the server's mode.
+Without a server URL, servers advertising over mDNS on the LAN are listed to pick from.`,
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		var bwLimit int64
+		if fsSyncClientFlags.bwLimit != "" {
+			var err error
+			if bwLimit, err = fssync.ParseBandwidth(fsSyncClientFlags.bwLimit); err != nil {
+				u.PrintFatal("Invalid --bwlimit", err)
+			}
+		}
+		var serverAddr string
+		if len(args) == 1 {
+			serverAddr = args[0]
+		} else {
+			serverAddr = discoverServer()
+		}
 		cfg := fssync.ClientConfig{
-			ServerAddr:  args[0],
-			SyncDir:     fsSyncClientFlags.dir,
-			DeleteExtra: fsSyncClientFlags.delete,
-			Insecure:    fsSyncClientFlags.insecure,
-			DryRun:      fsSyncClientFlags.dryRun,
-			IgnorePaths: fsSyncClientFlags.ignore,
+			ServerAddr:         serverAddr,
+			SyncDir:            fsSyncClientFlags.dir,
+			DeleteExtra:        fsSyncClientFlags.delete,
+			Insecure:           fsSyncClientFlags.insecure,
+			DryRun:             fsSyncClientFlags.dryRun,
+			IgnorePaths:        fsSyncClientFlags.ignore,
+			Gitignore:          fsSyncClientFlags.gitignore,
+			Delta:              fsSyncClientFlags.delta,
+			Rehash:             fsSyncClientFlags.rehash,
+			PairingCode:        fsSyncClientFlags.code,
+			Fingerprint:        fsSyncClientFlags.fingerprint,
+			Parallel:           fsSyncClientFlags.parallel,
+			BWLimit:            bwLimit,
+			BackupDir:          backupDir(fsSyncClientFlags.backupDir, fsSyncClientFlags.noBackup),
+			Filter:             fsSyncClientFlags.filter.parse(),
+			RemotePath:         fsSyncClientFlags.remotePath,
+			DisableCompression: fsSyncClientFlags.noCompress,
 		}
 		c, err := fssync.NewClient(cfg)
 		if err != nil {
 			u.PrintFatal("Failed to initialize client", err)
 		}
-		cb := fssync.ClientCallbacks{
-			OnInfo: func(msg string) {
-				u.PrintInfo(msg)
-			},
-			OnGeneric: func(msg string) {
-				u.PrintGeneric(msg)
-			},
-			OnItemSuccess: func(msg string) {
-				u.PrintIndentedSuccess(msg)
-			},
-			OnWarn: func(msg string, err error) {
-				u.PrintWarn(msg, err)
-			},
-			OnSuccess: func(msg string) {
-				u.PrintSuccess(msg)
-			},
-			OnError: func(msg string, err error) {
-				u.PrintError(msg, err)
-			},
+		cb := clientCallbacks()
+		cb.OnReport = syncReporter(fsSyncClientFlags.report)
+		if fsSyncClientFlags.watch {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if err := c.Watch(ctx, cb); err != nil {
+				u.PrintFatal("Watch failed", err)
+			}
+			return
 		}
 		if err := c.Run(cb); err != nil {
 			u.PrintFatal("Sync failed", err)
@@ -105,23 +225,337 @@ var fsSyncClientCmd = &cobra.Command{
 	},
 }
 
+// clientCallbacks prints client events. Transfers run in parallel, so output
+// is serialized and the progress line is cleared before anything else prints.
+func clientCallbacks() fssync.ClientCallbacks {
+	var mu sync.Mutex
+	progressShown := false
+	clearProgress := func() {
+		if progressShown {
+			u.ClearPreviousLine()
+			progressShown = false
+		}
+	}
+	emit := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		clearProgress()
+		fn()
+	}
+	return fssync.ClientCallbacks{
+		OnInfo: func(msg string) {
+			emit(func() { u.PrintInfo(msg) })
+		},
+		OnGeneric: func(msg string) {
+			emit(func() { u.PrintGeneric(msg) })
+		},
+		OnItemSuccess: func(msg string) {
+			emit(func() { u.PrintIndentedSuccess(msg) })
+		},
+		OnWarn: func(msg string, err error) {
+			emit(func() { u.PrintWarn(msg, err) })
+		},
+		OnSuccess: func(msg string) {
+			emit(func() { u.PrintSuccess(msg) })
+		},
+		OnError: func(msg string, err error) {
+			emit(func() { u.PrintError(msg, err) })
+		},
+		OnProgress: func(label string, percent int) {
+			emit(func() {
+				u.PrintProgress(label, percent)
+				progressShown = true
+			})
+		},
+		OnProgressDone: func() {
+			emit(func() {})
+		},
+	}
+}
+
+var fsSyncExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the files another machine needs to a tar or zip bundle (offline sync)",
+	Long: `Write this directory's manifest and the files another machine needs to a bundle,
+for syncing machines that cannot reach each other. With --against, only files missing
+or different on the machine that exported that bundle are included; otherwise all are.
+Use --manifest-only on the receiving machine to produce the bundle to export against.
+The format follows the output name: .zip, .tar.gz/.tgz or .tar.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := fssync.ClientConfig{
+			SyncDir:     fsSyncExportFlags.dir,
+			DryRun:      fsSyncExportFlags.dryRun,
+			IgnorePaths: fsSyncExportFlags.ignore,
+			Gitignore:   fsSyncExportFlags.gitignore,
+			Rehash:      fsSyncExportFlags.rehash,
+			Filter:      fsSyncExportFlags.filter.parse(),
+		}
+		c, err := fssync.NewClient(cfg)
+		if err != nil {
+			u.PrintFatal("Failed to initialize export", err)
+		}
+		cb := clientCallbacks()
+		cb.OnReport = syncReporter(fsSyncExportFlags.report)
+		if err := c.Export(fsSyncExportFlags.output, fsSyncExportFlags.against, fsSyncExportFlags.manifestOnly, cb); err != nil {
+			u.PrintFatal("Export failed", err)
+		}
+	},
+}
+
+var fsSyncImportCmd = &cobra.Command{
+	Use:   "import <bundle>",
+	Short: "Apply a bundle written by fs-sync export to a directory",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := fssync.ClientConfig{
+			SyncDir:     fsSyncImportFlags.dir,
+			DeleteExtra: fsSyncImportFlags.delete,
+			DryRun:      fsSyncImportFlags.dryRun,
+			IgnorePaths: fsSyncImportFlags.ignore,
+			Gitignore:   fsSyncImportFlags.gitignore,
+			Rehash:      fsSyncImportFlags.rehash,
+			BackupDir:   backupDir(fsSyncImportFlags.backupDir, fsSyncImportFlags.noBackup),
+			Filter:      fsSyncImportFlags.filter.parse(),
+		}
+		c, err := fssync.NewClient(cfg)
+		if err != nil {
+			u.PrintFatal("Failed to initialize import", err)
+		}
+		cb := clientCallbacks()
+		cb.OnReport = syncReporter(fsSyncImportFlags.report)
+		if err := c.Import(args[0], cb); err != nil {
+			u.PrintFatal("Import failed", err)
+		}
+	},
+}
+
+var fsSyncRestoreCmd = &cobra.Command{
+	Use:   "restore [session]",
+	Short: "Roll back a sync session from the backup directory (latest by default)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sessions, err := fssync.TrashSessions(fsSyncRestoreFlags.dir, fsSyncRestoreFlags.backupDir)
+		if err != nil {
+			u.PrintFatal("Failed to read backup directory", err)
+		}
+		if fsSyncRestoreFlags.list {
+			if len(sessions) == 0 {
+				u.PrintWarn("No backup sessions found", nil)
+			}
+			for _, session := range sessions {
+				u.PrintGeneric(session)
+			}
+			return
+		}
+		var session string
+		if len(args) == 1 {
+			session = args[0]
+		} else if len(sessions) > 0 {
+			session = sessions[len(sessions)-1]
+		} else {
+			u.PrintFatal("No backup sessions found", nil)
+		}
+		u.PrintInfo(fmt.Sprintf("Restoring session %s", session))
+		result, err := fssync.Restore(fsSyncRestoreFlags.dir, fsSyncRestoreFlags.backupDir, session)
+		if result != nil {
+			for _, path := range result.Removed {
+				u.PrintIndentedSuccess(fmt.Sprintf("Removed: %s", path))
+			}
+			for _, path := range result.Restored {
+				u.PrintIndentedSuccess(fmt.Sprintf("Restored: %s", path))
+			}
+		}
+		if err != nil {
+			u.PrintFatal("Restore failed", err)
+		}
+		u.PrintSuccess(fmt.Sprintf("%d file(s) restored, %d removed", len(result.Restored), len(result.Removed)))
+	},
+}
+
+func (f *fsSyncFilterFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.include, "include", "", "Only sync files matching these comma-separated gitignore-style patterns (e.g., '*.md,docs/')")
+	cmd.Flags().StringVar(&f.minSize, "min-size", "", "Only sync files at least this large (e.g., '10K')")
+	cmd.Flags().StringVar(&f.maxSize, "max-size", "", "Only sync files at most this large (e.g., '100MB')")
+	cmd.Flags().StringVar(&f.newerThan, "newer-than", "", "Only sync files modified within this long (e.g., '7d', '12h')")
+	cmd.Flags().StringVar(&f.olderThan, "older-than", "", "Only sync files last modified longer ago than this (e.g., '2w')")
+}
+
+func (f *fsSyncFilterFlags) parse() fssync.Filter {
+	filter := fssync.Filter{Include: f.include}
+	var err error
+	if f.minSize != "" {
+		if filter.MinSize, err = fssync.ParseSize(f.minSize); err != nil {
+			u.PrintFatal("Invalid --min-size", err)
+		}
+	}
+	if f.maxSize != "" {
+		if filter.MaxSize, err = fssync.ParseSize(f.maxSize); err != nil {
+			u.PrintFatal("Invalid --max-size", err)
+		}
+	}
+	if f.newerThan != "" {
+		if filter.NewerThan, err = fssync.ParseAge(f.newerThan); err != nil {
+			u.PrintFatal("Invalid --newer-than", err)
+		}
+	}
+	if f.olderThan != "" {
+		if filter.OlderThan, err = fssync.ParseAge(f.olderThan); err != nil {
+			u.PrintFatal("Invalid --older-than", err)
+		}
+	}
+	return filter
+}
+
+func backupDir(dir string, disabled bool) string {
+	if disabled {
+		return ""
+	}
+	return dir
+}
+
+// syncReporter writes each session's report to path, replacing the previous
+// one in watch mode, and prints it as JSON for --for-ai.
+func syncReporter(path string) func(*fssync.SyncReport) {
+	if path == "" && !u.GlobalForAIFlag {
+		return nil
+	}
+	return func(report *fssync.SyncReport) {
+		if path != "" {
+			if err := report.WriteFile(path); err != nil {
+				u.PrintWarn("Failed to write sync report", err)
+			}
+		}
+		if u.GlobalForAIFlag {
+			data, err := report.JSON()
+			if err != nil {
+				u.PrintWarn("Failed to encode sync report", err)
+				return
+			}
+			u.PrintGeneric(string(data))
+		}
+	}
+}
+
+// discoverServer browses the LAN and lets the user pick a server. With TLS
+// and neither -k nor --fingerprint, the advertised fingerprint is pinned
+// only once the user confirms it matches the one the server printed: an
+// mDNS record is unauthenticated, so anyone on the LAN could forge it.
+func discoverServer() string {
+	u.PrintInfo("Searching the LAN for fs-sync servers...")
+	servers, err := fssync.Discover(context.Background())
+	if err != nil {
+		u.PrintFatal("Server discovery failed", err)
+	}
+	if len(servers) == 0 {
+		u.PrintFatal("No fs-sync servers found; pass a server URL instead", nil)
+	}
+	options := make([]string, len(servers))
+	for i, server := range servers {
+		options[i] = server.String()
+	}
+	idx, err := u.PromptSelect("Select a server", options)
+	if err != nil {
+		u.PrintFatal("Failed to select a server", err)
+	}
+	if idx < 0 {
+		u.PrintFatal("No server selected", nil)
+	}
+	server := servers[idx]
+	if server.Fingerprint != "" && fsSyncClientFlags.fingerprint == "" && !fsSyncClientFlags.insecure {
+		u.PrintInfo(fmt.Sprintf("Advertised TLS fingerprint (SHA-256): %s", server.Fingerprint))
+		confirm, err := u.PromptSelect("Does this match the fingerprint the server printed?", []string{
+			"Yes, pin this fingerprint",
+			"No, cancel",
+		})
+		if err != nil || confirm != 0 {
+			u.PrintFatal("Fingerprint not confirmed; pass the one the server printed with --fingerprint", err)
+		}
+		fsSyncClientFlags.fingerprint = server.Fingerprint
+	}
+	return server.URL
+}
 
 func init() {
-	fsSyncServeCmd.Flags().StringVarP(&fsSyncServeFlags.mode, "mode", "m", "send", "Sync mode: 'send' (serve files) or 'receive' (accept files)")
+	fsSyncServeCmd.Flags().StringVarP(&fsSyncServeFlags.mode, "mode", "m", "send", "Sync mode: 'send' (serve files), 'receive' (accept files) or 'both' (two-way merge)")
 	fsSyncServeCmd.Flags().IntVarP(&fsSyncServeFlags.port, "port", "p", 8080, "Port to listen on")
 	fsSyncServeCmd.Flags().StringVarP(&fsSyncServeFlags.dir, "dir", "d", ".", "Directory to sync")
-	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.ignore, "ignore", "", "Comma-separated patterns to ignore (e.g., '.git,node_modules')")
+	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.ignore, "ignore", "", "Comma-separated gitignore-style patterns, applied after .nitsignore (e.g., '.git,node_modules/')")
+	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.gitignore, "gitignore", false, "Also skip paths listed in the directory's .gitignore")
 	fsSyncServeCmd.Flags().BoolVarP(&fsSyncServeFlags.enableTLS, "tls", "t", false, "Enable HTTPS with self-signed cert")
-	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.delete, "delete", false, "Delete extra files not present on sender (receive mode only)")
-	fsSyncServeCmd.Flags().BoolVarP(&fsSyncServeFlags.dryRun, "dry-run", "r", false, "Show what would be synced without doing it (receive mode only)")
+	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.delete, "delete", false, "Delete extra files not present on sender (receive and both modes)")
+	fsSyncServeCmd.Flags().BoolVarP(&fsSyncServeFlags.dryRun, "dry-run", "r", false, "Show what would be synced without doing it (receive and both modes)")
+	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.rehash, "rehash", false, "Ignore the manifest cache and rehash every file")
+	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.code, "code", "", "First pairing code; each code pairs one client (default: random)")
+	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.noAuth, "no-auth", false, "Accept clients without a pairing code")
+	fsSyncServeCmd.MarkFlagsMutuallyExclusive("code", "no-auth")
+	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.certFile, "cert", "", "TLS certificate file (created with --key if missing) for a stable fingerprint")
+	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.keyFile, "key", "", "TLS private key file (created with --cert if missing)")
+	fsSyncServeCmd.MarkFlagsRequiredTogether("cert", "key")
+	fsSyncServeCmd.Flags().BoolVarP(&fsSyncServeFlags.watch, "watch", "w", false, "Keep serving after each sync until interrupted")
+	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.noMDNS, "no-mdns", false, "Do not advertise the server on the LAN over mDNS")
+	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.report, "report", "", "Write a JSON report of each sync session to this file")
+	fsSyncServeCmd.Flags().StringVar(&fsSyncServeFlags.backupDir, "backup-dir", fssync.DefaultBackupDir, "Keep deleted and overwritten files under DIR/<timestamp> (relative to --dir)")
+	fsSyncServeCmd.Flags().BoolVar(&fsSyncServeFlags.noBackup, "no-backup", false, "Delete and overwrite files without keeping a backup")
+	fsSyncServeCmd.MarkFlagsMutuallyExclusive("backup-dir", "no-backup")
+	fsSyncServeCmd.Flags().IntVar(&fsSyncServeFlags.maxClients, "max-clients", 0, "Serve this many clients, concurrently or in turn, before exiting (default 1, or unlimited with --timeout)")
+	fsSyncServeCmd.Flags().DurationVar(&fsSyncServeFlags.timeout, "timeout", 0, "Exit after this long even if clients are still expected (e.g., '30m')")
+	fsSyncServeCmd.MarkFlagsMutuallyExclusive("watch", "max-clients")
+	fsSyncServeFlags.filter.register(fsSyncServeCmd)
 
 	fsSyncClientCmd.Flags().StringVarP(&fsSyncClientFlags.dir, "dir", "d", ".", "Local directory to sync")
-	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.ignore, "ignore", "", "Comma-separated patterns to ignore (e.g., '.git,node_modules')")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.ignore, "ignore", "", "Comma-separated gitignore-style patterns, applied after .nitsignore (e.g., '.git,node_modules/')")
+	fsSyncClientCmd.Flags().BoolVar(&fsSyncClientFlags.gitignore, "gitignore", false, "Also skip paths listed in the directory's .gitignore")
 	fsSyncClientCmd.Flags().BoolVarP(&fsSyncClientFlags.insecure, "insecure", "k", false, "Skip TLS certificate verification")
 	fsSyncClientCmd.Flags().BoolVar(&fsSyncClientFlags.delete, "delete", false, "Delete extra files not present on sender")
 	fsSyncClientCmd.Flags().BoolVarP(&fsSyncClientFlags.dryRun, "dry-run", "r", false, "Show what would be synced without doing it")
+	fsSyncClientCmd.Flags().BoolVar(&fsSyncClientFlags.delta, "delta", false, "Send only changed blocks of large files that exist on both sides")
+	fsSyncClientCmd.Flags().BoolVar(&fsSyncClientFlags.rehash, "rehash", false, "Ignore the manifest cache and rehash every file")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.code, "code", "", "Pairing code printed by the server")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.fingerprint, "fingerprint", "", "Pin the server's TLS certificate by its SHA-256 fingerprint")
+	fsSyncClientCmd.MarkFlagsMutuallyExclusive("fingerprint", "insecure")
+	fsSyncClientCmd.Flags().BoolVarP(&fsSyncClientFlags.watch, "watch", "w", false, "Keep syncing local changes as they happen until interrupted")
+	fsSyncClientCmd.Flags().BoolVar(&fsSyncClientFlags.noCompress, "no-compress", false, "Send files uncompressed even if the server supports gzip")
+	fsSyncClientCmd.Flags().IntVarP(&fsSyncClientFlags.parallel, "parallel", "P", 4, "Number of files to transfer at once")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.bwLimit, "bwlimit", "", "Limit total transfer rate in bytes per second (e.g., '500K', '10M')")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.report, "report", "", "Write a JSON report of the sync to this file")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.backupDir, "backup-dir", fssync.DefaultBackupDir, "Keep deleted and overwritten files under DIR/<timestamp> (relative to --dir)")
+	fsSyncClientCmd.Flags().BoolVar(&fsSyncClientFlags.noBackup, "no-backup", false, "Delete and overwrite files without keeping a backup")
+	fsSyncClientCmd.MarkFlagsMutuallyExclusive("backup-dir", "no-backup")
+	fsSyncClientCmd.Flags().StringVar(&fsSyncClientFlags.remotePath, "remote-path", "", "Sync only this subdirectory of the server's directory (e.g., 'photos/2025')")
+	fsSyncClientFlags.filter.register(fsSyncClientCmd)
+
+	fsSyncExportCmd.Flags().StringVarP(&fsSyncExportFlags.dir, "dir", "d", ".", "Directory to export from")
+	fsSyncExportCmd.Flags().StringVarP(&fsSyncExportFlags.output, "output", "o", "", "Bundle file to write (.zip, .tar.gz, .tgz or .tar)")
+	fsSyncExportCmd.MarkFlagRequired("output")
+	fsSyncExportCmd.Flags().StringVar(&fsSyncExportFlags.against, "against", "", "Bundle exported by the receiving machine; include only the files it lacks or holds in another version")
+	fsSyncExportCmd.Flags().BoolVar(&fsSyncExportFlags.manifestOnly, "manifest-only", false, "Write only the manifest, for the other machine to export against")
+	fsSyncExportCmd.MarkFlagsMutuallyExclusive("against", "manifest-only")
+	fsSyncExportCmd.Flags().StringVar(&fsSyncExportFlags.ignore, "ignore", "", "Comma-separated gitignore-style patterns, applied after .nitsignore (e.g., '.git,node_modules/')")
+	fsSyncExportCmd.Flags().BoolVar(&fsSyncExportFlags.gitignore, "gitignore", false, "Also skip paths listed in the directory's .gitignore")
+	fsSyncExportCmd.Flags().BoolVarP(&fsSyncExportFlags.dryRun, "dry-run", "r", false, "Show what would be exported without writing the bundle")
+	fsSyncExportCmd.Flags().BoolVar(&fsSyncExportFlags.rehash, "rehash", false, "Ignore the manifest cache and rehash every file")
+	fsSyncExportCmd.Flags().StringVar(&fsSyncExportFlags.report, "report", "", "Write a JSON report of the export to this file")
+	fsSyncExportFlags.filter.register(fsSyncExportCmd)
+
+	fsSyncImportCmd.Flags().StringVarP(&fsSyncImportFlags.dir, "dir", "d", ".", "Directory to apply the bundle to")
+	fsSyncImportCmd.Flags().StringVar(&fsSyncImportFlags.ignore, "ignore", "", "Comma-separated gitignore-style patterns, applied after .nitsignore (e.g., '.git,node_modules/')")
+	fsSyncImportCmd.Flags().BoolVar(&fsSyncImportFlags.gitignore, "gitignore", false, "Also skip paths listed in the directory's .gitignore")
+	fsSyncImportCmd.Flags().BoolVar(&fsSyncImportFlags.delete, "delete", false, "Delete files not present on the exporting machine")
+	fsSyncImportCmd.Flags().BoolVarP(&fsSyncImportFlags.dryRun, "dry-run", "r", false, "Show what would be synced without doing it")
+	fsSyncImportCmd.Flags().BoolVar(&fsSyncImportFlags.rehash, "rehash", false, "Ignore the manifest cache and rehash every file")
+	fsSyncImportCmd.Flags().StringVar(&fsSyncImportFlags.report, "report", "", "Write a JSON report of the import to this file")
+	fsSyncImportCmd.Flags().StringVar(&fsSyncImportFlags.backupDir, "backup-dir", fssync.DefaultBackupDir, "Keep deleted and overwritten files under DIR/<timestamp> (relative to --dir)")
+	fsSyncImportCmd.Flags().BoolVar(&fsSyncImportFlags.noBackup, "no-backup", false, "Delete and overwrite files without keeping a backup")
+	fsSyncImportCmd.MarkFlagsMutuallyExclusive("backup-dir", "no-backup")
+	fsSyncImportFlags.filter.register(fsSyncImportCmd)
 
+	fsSyncRestoreCmd.Flags().StringVarP(&fsSyncRestoreFlags.dir, "dir", "d", ".", "Sync directory to restore into")
+	fsSyncRestoreCmd.Flags().StringVar(&fsSyncRestoreFlags.backupDir, "backup-dir", fssync.DefaultBackupDir, "Backup directory the sessions were kept in (relative to --dir)")
+	fsSyncRestoreCmd.Flags().BoolVarP(&fsSyncRestoreFlags.list, "list", "l", false, "List backup sessions, oldest first, without restoring")
 
 	FSSyncCmd.AddCommand(fsSyncServeCmd)
 	FSSyncCmd.AddCommand(fsSyncClientCmd)
+	FSSyncCmd.AddCommand(fsSyncExportCmd)
+	FSSyncCmd.AddCommand(fsSyncImportCmd)
+	FSSyncCmd.AddCommand(fsSyncRestoreCmd)
 }
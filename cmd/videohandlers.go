@@ -6,7 +6,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -17,12 +19,23 @@ import (
 )
 
 var videoOptimizeFlags struct {
-	codec  string
-	manual bool
+	codec     string
+	manual    bool
+	recursive bool
+	jobs      int
+	queue     string
+	size      string
+	bitrate   string
+	vmaf      float64
+	ssim      float64
+	profile   string
+	container string
+	audio     string
+	subs      string
 }
 
 var videoOptimizeCmd = &cobra.Command{
-	Use:     "video-optimize <file>",
+	Use:     "video-optimize <file|dir>",
 	Aliases: []string{"video-opt"},
 	Short:   "Optimize video file (H.265 or AV1, max 1080p, 8-bit SDR, AAC 128k)",
 	Long: `Optimizes a video file for size reduction using CPU H.265 (default) or AV1 encoding.
@@ -31,9 +44,25 @@ while lower resolutions are preserved. 10-bit HDR videos are automatically tone-
 to 8-bit SDR. Encodes audio to 128 kbps AAC stereo.
 
 Use --codec av1 to encode using libsvtav1.
+Use --profile to start from a named set of settings: archive, phone, lecture,
+or one defined in ~/.config/nits/video-profiles.yaml. Other flags override it.
 Use --manual to interactively configure codec, CRF, resolution, audio, and presets.
+Use --target-size (e.g. 500MB) or --target-bitrate (e.g. 2500k) instead of CRF to
+run a two-pass encode at the bitrate that fits the size or matches the rate.
+Use --target-vmaf (e.g. 93) or --target-ssim to pick the highest CRF whose quality,
+scored on short samples, meets the target (SSIM is used if ffmpeg lacks libvmaf).
 
-Output file is saved as <basename>.optimized.mp4.`,
+Output file is saved as <basename>.optimized.mp4, or .optimized.mkv with
+--container mkv. One audio track (skipping commentary) and all subtitles, as
+mov_text, are kept by default. Use --audio and --subs with all, none, or
+lang:eng,jpn to choose tracks. MKV output copies the tracks --audio picks
+as-is (MP4 encodes them to AAC stereo) and keeps image-based (PGS/VobSub)
+subtitles, which MP4 cannot hold.
+
+Given a directory, every video in it (with --recursive, in its subdirectories
+too) is encoded, skipping those that already have an optimized output.
+Use --jobs to encode several at once. Progress is kept in a queue file in the
+directory, so re-running an interrupted batch resumes where it left off.`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -41,148 +70,86 @@ Output file is saved as <basename>.optimized.mp4.`,
 
 		inputFile := args[0]
 		inputBase := filepath.Base(inputFile)
+		info, err := os.Stat(inputFile)
+		if err != nil {
+			utils.PrintFatal("Failed to read input", err)
+		}
 
 		opts := videohandlers.DefaultOptimizeOptions()
-		if videoOptimizeFlags.codec != "" {
-			c := strings.ToLower(videoOptimizeFlags.codec)
-			if c == "av1" {
-				opts.Codec = "av1"
-				opts.CRF = 32
-				opts.Preset = "6"
-			} else {
-				opts.Codec = "hevc"
-			}
+		if videoOptimizeFlags.profile != "" {
+			applyVideoProfile(&opts, videoOptimizeFlags.profile)
 		}
-
-		if videoOptimizeFlags.manual {
-			data, err := videohandlers.GetVideoInfo(inputFile)
-			if err != nil {
-				utils.PrintFatal("Failed to probe video", err)
-			}
-
-			codecOptions := []string{
-				"H.265 / HEVC (Default — Universal hardware & device compatibility)",
-				"AV1 (Maximum compression via SVT-AV1, newer devices/browsers)",
-			}
-			codecIdx, err := utils.PromptSelect("Select video codec", codecOptions)
-			if err != nil || codecIdx < 0 {
-				utils.PrintInfo("Optimization cancelled")
-				return
+		// Flags given explicitly override the profile.
+		if cmd.Flags().Changed("codec") {
+			c := strings.ToLower(videoOptimizeFlags.codec)
+			if c != "av1" {
+				c = "hevc"
 			}
-			if codecIdx == 1 {
-				opts.Codec = "av1"
-			} else {
-				opts.Codec = "hevc"
+			if c != opts.Codec {
+				// CRF and preset fall back to the new codec's defaults.
+				opts.Codec = c
+				opts.CRF = 0
+				opts.Preset = ""
 			}
+		}
 
-			var crfOptions []string
-			var crfValues []int
-			if opts.Codec == "av1" {
-				crfOptions = []string{
-					"32 (Default — High Compression, ~65-75% size reduction)",
-					"30 (Balanced Quality — Crisp 1080p details, ~55-65% size reduction)",
-					"28 (High Quality — Great for fast motion)",
-					"24 (Very High Quality — Near-source transparent)",
-					"36 (Very High Compression — Smallest size, tutorials/talks)",
-					"40 (Maximum Compression — Extreme compression)",
-				}
-				crfValues = []int{32, 30, 28, 24, 36, 40}
-			} else {
-				crfOptions = []string{
-					"30 (Default — High Compression, ~65-75% size reduction)",
-					"28 (Balanced Quality — Crisp 1080p details, ~50-65% size reduction)",
-					"26 (Medium-High Quality — Recommended for action/sports)",
-					"24 (High Quality — Near-source transparent)",
-					"22 (Very High Quality — Archival quality)",
-					"32 (Very High Compression — Smallest size, tutorials/talks)",
-					"34 (Maximum Compression — Extreme compression)",
-				}
-				crfValues = []int{30, 28, 26, 24, 22, 32, 34}
+		if slices.ContainsFunc([]string{"target-size", "target-bitrate", "target-vmaf", "target-ssim"}, cmd.Flags().Changed) {
+			opts.TargetSize, opts.TargetBitrate, opts.TargetVMAF, opts.TargetSSIM = 0, 0, 0, 0
+		}
+		if videoOptimizeFlags.size != "" {
+			if opts.TargetSize, err = videohandlers.ParseSize(videoOptimizeFlags.size); err != nil {
+				utils.PrintFatal("Invalid --target-size", err)
 			}
-
-			crfIdx, err := utils.PromptSelect("Select CRF quality/compression factor", crfOptions)
-			if err != nil || crfIdx < 0 {
-				utils.PrintInfo("Optimization cancelled")
-				return
+		}
+		if videoOptimizeFlags.bitrate != "" {
+			if opts.TargetBitrate, err = videohandlers.ParseBitrate(videoOptimizeFlags.bitrate); err != nil {
+				utils.PrintFatal("Invalid --target-bitrate", err)
 			}
-			opts.CRF = crfValues[crfIdx]
+		}
 
-			resOptions := []string{
-				"1080p (Default — Max 1920x1080, keep if lower)",
-				"720p (Max 1280x720, keep if lower)",
-				"480p (Max 854x480 SD, keep if lower)",
-				"Original (Preserve native resolution)",
-			}
-			resValues := []string{"1080p", "720p", "480p", "none"}
-			resIdx, err := utils.PromptSelect("Select maximum resolution target", resOptions)
-			if err != nil || resIdx < 0 {
-				utils.PrintInfo("Optimization cancelled")
-				return
-			}
-			opts.MaxRes = resValues[resIdx]
+		if videoOptimizeFlags.vmaf != 0 && (videoOptimizeFlags.vmaf < 0 || videoOptimizeFlags.vmaf > 100) {
+			utils.PrintFatal("--target-vmaf must be between 0 and 100", nil)
+		}
+		if videoOptimizeFlags.ssim != 0 && (videoOptimizeFlags.ssim < 0 || videoOptimizeFlags.ssim > 1) {
+			utils.PrintFatal("--target-ssim must be between 0 and 1", nil)
+		}
+		if videoOptimizeFlags.vmaf != 0 {
+			opts.TargetVMAF = videoOptimizeFlags.vmaf
+		}
+		if videoOptimizeFlags.ssim != 0 {
+			opts.TargetSSIM = videoOptimizeFlags.ssim
+		}
 
-			audioOptions := []string{
-				"128 kbps (Default — AAC Stereo)",
-				"160 kbps (Higher bitrate AAC Stereo)",
-				"96 kbps (Lower bitrate AAC Stereo)",
-				"No Audio (Strip all audio tracks)",
+		if cmd.Flags().Changed("container") {
+			c := strings.ToLower(videoOptimizeFlags.container)
+			if c != "mp4" && c != "mkv" {
+				utils.PrintFatal("--container must be mp4 or mkv", nil)
 			}
-			audioValues := []string{"128k", "160k", "96k", "none"}
-			audioIdx, err := utils.PromptSelect("Select audio configuration", audioOptions)
-			if err != nil || audioIdx < 0 {
-				utils.PrintInfo("Optimization cancelled")
-				return
+			opts.Container = c
+		}
+		if videoOptimizeFlags.audio != "" {
+			if err := videohandlers.ValidateTrackSelection(videoOptimizeFlags.audio); err != nil {
+				utils.PrintFatal("Invalid --audio", err)
 			}
-			opts.AudioMode = audioValues[audioIdx]
-
-			var presetOptions []string
-			var presetValues []string
-			if opts.Codec == "av1" {
-				presetOptions = []string{
-					"6 (Default — Balanced speed and compression)",
-					"4 (Better compression, ~2x longer encode)",
-					"8 (Faster encode, slightly larger file)",
-				}
-				presetValues = []string{"6", "4", "8"}
-			} else {
-				presetOptions = []string{
-					"medium (Default — Balanced speed and compression)",
-					"slow (Better compression, ~2x longer encode)",
-					"fast (Faster encode, ~5-10% larger file)",
-				}
-				presetValues = []string{"medium", "slow", "fast"}
+			opts.AudioTracks = videoOptimizeFlags.audio
+		}
+		if videoOptimizeFlags.subs != "" {
+			if err := videohandlers.ValidateTrackSelection(videoOptimizeFlags.subs); err != nil {
+				utils.PrintFatal("Invalid --subs", err)
 			}
+			opts.SubTracks = videoOptimizeFlags.subs
+		}
 
-			presetIdx, err := utils.PromptSelect("Select encoder speed preset", presetOptions)
-			if err != nil || presetIdx < 0 {
-				utils.PrintInfo("Optimization cancelled")
+		if info.IsDir() {
+			if videoOptimizeFlags.manual && !promptOptimizeOptions(&opts, "") {
 				return
 			}
-			opts.Preset = presetValues[presetIdx]
+			runVideoBatch(ctx, inputFile, opts)
+			return
+		}
 
-			var primaryVideo *videohandlers.Stream
-			for _, s := range data.Streams {
-				if s.CodecType == "video" {
-					primaryVideo = &s
-					break
-				}
-			}
-			if primaryVideo != nil && videohandlers.IsHDRStream(*primaryVideo) {
-				hdrOptions := []string{
-					"Tone-map HDR to SDR 8-bit (Default — Prevents washed-out colors)",
-					"Direct 8-bit conversion without tone mapping",
-				}
-				hdrIdx, err := utils.PromptSelect("HDR source detected: Select color processing", hdrOptions)
-				if err != nil || hdrIdx < 0 {
-					utils.PrintInfo("Optimization cancelled")
-					return
-				}
-				if hdrIdx == 0 {
-					opts.ToneMap = "yes"
-				} else {
-					opts.ToneMap = "no"
-				}
-			}
+		if videoOptimizeFlags.manual && !promptOptimizeOptions(&opts, inputFile) {
+			return
 		}
 
 		utils.PrintRunning(fmt.Sprintf("Optimizing %s...", inputBase))
@@ -218,55 +185,365 @@ Output file is saved as <basename>.optimized.mp4.`,
 			utils.PrintFatal("Failed to optimize video", err)
 		}
 
-		savedBytes := res.InputBytes - res.OutputBytes
-		savedPct := 0.0
-		if res.InputBytes > 0 {
-			savedPct = float64(savedBytes) / float64(res.InputBytes) * 100
+		printOptimizeResult(res)
+	},
+}
+
+// applyVideoProfile sets opts from the named profile, built in or defined in
+// ~/.config/nits/video-profiles.yaml.
+func applyVideoProfile(opts *videohandlers.OptimizeOptions, name string) {
+	path, err := videohandlers.ProfilesPath()
+	if err != nil {
+		utils.PrintFatal("Failed to locate profiles file", err)
+	}
+	profiles, err := videohandlers.LoadVideoProfiles(path)
+	if err != nil {
+		utils.PrintFatal("Failed to load video profiles", err)
+	}
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		utils.PrintFatal(fmt.Sprintf("Unknown profile %q (available: %s)", name, strings.Join(videohandlers.ProfileNames(profiles), ", ")), nil)
+	}
+	if err := profile.Apply(opts); err != nil {
+		utils.PrintFatal(fmt.Sprintf("Invalid profile %q", name), err)
+	}
+	utils.PrintInfo(fmt.Sprintf("Using profile %s", strings.ToLower(name)))
+}
+
+func runVideoBatch(ctx context.Context, dir string, opts videohandlers.OptimizeOptions) {
+	// The queue records absolute paths so a batch resumes from any working
+	// directory; output shows them relative to dir.
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		utils.PrintFatal("Failed to resolve directory", err)
+	}
+	display := func(path string) string {
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			return rel
+		}
+		return path
+	}
+	files, err := videohandlers.DiscoverVideos(dir, videoOptimizeFlags.recursive)
+	if err != nil {
+		utils.PrintFatal("Failed to scan directory", err)
+	}
+	queuePath := videoOptimizeFlags.queue
+	if queuePath == "" {
+		queuePath = filepath.Join(dir, videohandlers.DefaultQueueFile)
+	}
+	queue, err := videohandlers.LoadBatchQueue(queuePath, files)
+	if err != nil {
+		utils.PrintFatal("Failed to load batch queue", err)
+	}
+	remaining := queue.Remaining()
+	if remaining == 0 {
+		utils.PrintWarn("No videos to optimize", nil)
+		queue.Remove()
+		return
+	}
+	utils.PrintInfo(fmt.Sprintf("Optimizing %d of %d video(s), %d at a time (queue: %s)", remaining, len(queue.Jobs), max(videoOptimizeFlags.jobs, 1), queuePath))
+
+	var mu sync.Mutex
+	var printed atomic.Bool
+	var firstTick atomic.Bool
+	firstTick.Store(true)
+	callbacks := videohandlers.BatchCallbacks{
+		OnJobStart: func(job *videohandlers.BatchJob, index, total int) {
+			mu.Lock()
+			defer mu.Unlock()
+			utils.PrintRunning(fmt.Sprintf("[%d/%d] Optimizing %s...", index, total, display(job.Input)))
+			firstTick.Store(true)
+			printed.Store(false)
+		},
+		OnJobDone: func(job *videohandlers.BatchJob) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch job.Status {
+			case videohandlers.JobSkipped:
+				utils.PrintIndentedWarn(fmt.Sprintf("Skipped %s (output exists)", display(job.Input)), nil)
+			case videohandlers.JobFailed:
+				utils.PrintIndentedError(fmt.Sprintf("Failed %s: %s", display(job.Input), job.Error), nil)
+			default:
+				utils.PrintIndentedSuccess(fmt.Sprintf("Optimized %s → %s (%s → %s)", display(job.Input), filepath.Base(job.Output),
+					videohandlers.FormatSize(float64(job.InputBytes)), videohandlers.FormatSize(float64(job.OutputBytes))))
+			}
+		},
+		Encode: videohandlers.EncodeCallbacks{
+			OnProgress: func(label string, percent int) {
+				if !firstTick.Swap(false) {
+					utils.ClearPreviousLine()
+				}
+				printed.Store(true)
+				utils.PrintProgress(label, percent)
+			},
+			OnProgressDone: func() {
+				if printed.Load() {
+					utils.ClearPreviousLine()
+				}
+			},
+			OnError: func(msg string) {
+				utils.PrintIndentedError(msg, nil)
+			},
+		},
+	}
+
+	err = videohandlers.RunVideoBatch(ctx, queue, opts, videoOptimizeFlags.jobs, callbacks)
+	if ctx.Err() != nil {
+		utils.PrintWarn(fmt.Sprintf("Batch interrupted; run again to resume (%d video(s) left)", queue.Remaining()), nil)
+		return
+	}
+	if err != nil {
+		utils.PrintFatal("Batch failed", err)
+	}
+
+	var done, skipped, failed int
+	var inputBytes, outputBytes int64
+	for _, job := range queue.Jobs {
+		switch job.Status {
+		case videohandlers.JobDone:
+			done++
+			inputBytes += job.InputBytes
+			outputBytes += job.OutputBytes
+		case videohandlers.JobSkipped:
+			skipped++
+		case videohandlers.JobFailed:
+			failed++
 		}
+	}
+	if failed > 0 {
+		utils.PrintWarn(fmt.Sprintf("%d video(s) failed; run again to retry them", failed), nil)
+	} else {
+		queue.Remove()
+	}
+	utils.PrintTable([]string{"Property", "Value"}, [][]string{
+		{"Optimized", fmt.Sprintf("%d", done)},
+		{"Skipped", fmt.Sprintf("%d", skipped)},
+		{"Failed", fmt.Sprintf("%d", failed)},
+		{"Input Size", videohandlers.FormatSize(float64(inputBytes))},
+		{"Optimized Size", videohandlers.FormatSize(float64(outputBytes))},
+	})
+}
 
-		outputBase := filepath.Base(res.OutputFile)
-		utils.PrintSuccess(fmt.Sprintf("Optimized %s in %s (saved %.1f%%)", outputBase, res.TimeTaken.Round(time.Second), savedPct))
+// promptOptimizeOptions asks for each encode setting, returning false if the
+// user cancels. inputFile is probed to offer HDR handling when set.
+func promptOptimizeOptions(opts *videohandlers.OptimizeOptions, inputFile string) bool {
+	var data *videohandlers.FFProbeOutput
+	if inputFile != "" {
+		var err error
+		if data, err = videohandlers.GetVideoInfo(inputFile); err != nil {
+			utils.PrintFatal("Failed to probe video", err)
+		}
+	}
 
-		resStr := fmt.Sprintf("%dx%d", res.OrigWidth, res.OrigHeight)
-		if res.Scaled {
-			resStr += fmt.Sprintf(" → %s", res.TargetRes)
-		} else {
-			resStr += " (retained)"
+	codecOptions := []string{
+		"H.265 / HEVC (Default — Universal hardware & device compatibility)",
+		"AV1 (Maximum compression via SVT-AV1, newer devices/browsers)",
+	}
+	codecIdx, err := utils.PromptSelect("Select video codec", codecOptions)
+	if err != nil || codecIdx < 0 {
+		utils.PrintInfo("Optimization cancelled")
+		return false
+	}
+	if codecIdx == 1 {
+		opts.Codec = "av1"
+	} else {
+		opts.Codec = "hevc"
+	}
+
+	var crfOptions []string
+	var crfValues []int
+	if opts.Codec == "av1" {
+		crfOptions = []string{
+			"32 (Default — High Compression, ~65-75% size reduction)",
+			"30 (Balanced Quality — Crisp 1080p details, ~55-65% size reduction)",
+			"28 (High Quality — Great for fast motion)",
+			"24 (Very High Quality — Near-source transparent)",
+			"36 (Very High Compression — Smallest size, tutorials/talks)",
+			"40 (Maximum Compression — Extreme compression)",
 		}
+		crfValues = []int{32, 30, 28, 24, 36, 40}
+	} else {
+		crfOptions = []string{
+			"30 (Default — High Compression, ~65-75% size reduction)",
+			"28 (Balanced Quality — Crisp 1080p details, ~50-65% size reduction)",
+			"26 (Medium-High Quality — Recommended for action/sports)",
+			"24 (High Quality — Near-source transparent)",
+			"22 (Very High Quality — Archival quality)",
+			"32 (Very High Compression — Smallest size, tutorials/talks)",
+			"34 (Maximum Compression — Extreme compression)",
+		}
+		crfValues = []int{30, 28, 26, 24, 22, 32, 34}
+	}
+
+	crfIdx, err := utils.PromptSelect("Select CRF quality/compression factor", crfOptions)
+	if err != nil || crfIdx < 0 {
+		utils.PrintInfo("Optimization cancelled")
+		return false
+	}
+	opts.CRF = crfValues[crfIdx]
+
+	resOptions := []string{
+		"1080p (Default — Max 1920x1080, keep if lower)",
+		"720p (Max 1280x720, keep if lower)",
+		"480p (Max 854x480 SD, keep if lower)",
+		"Original (Preserve native resolution)",
+	}
+	resValues := []string{"1080p", "720p", "480p", "none"}
+	resIdx, err := utils.PromptSelect("Select maximum resolution target", resOptions)
+	if err != nil || resIdx < 0 {
+		utils.PrintInfo("Optimization cancelled")
+		return false
+	}
+	opts.MaxRes = resValues[resIdx]
 
-		spaceSavedStr := fmt.Sprintf("%s (%.1f%%)", videohandlers.FormatSize(float64(savedBytes)), savedPct)
-		if savedBytes < 0 {
-			spaceSavedStr = fmt.Sprintf("+%s", videohandlers.FormatSize(float64(-savedBytes)))
+	audioOptions := []string{
+		"128 kbps (Default — AAC Stereo)",
+		"160 kbps (Higher bitrate AAC Stereo)",
+		"96 kbps (Lower bitrate AAC Stereo)",
+		"No Audio (Strip all audio tracks)",
+	}
+	audioValues := []string{"128k", "160k", "96k", "none"}
+	audioIdx, err := utils.PromptSelect("Select audio configuration", audioOptions)
+	if err != nil || audioIdx < 0 {
+		utils.PrintInfo("Optimization cancelled")
+		return false
+	}
+	opts.AudioMode = audioValues[audioIdx]
+
+	var presetOptions []string
+	var presetValues []string
+	if opts.Codec == "av1" {
+		presetOptions = []string{
+			"6 (Default — Balanced speed and compression)",
+			"4 (Better compression, ~2x longer encode)",
+			"8 (Faster encode, slightly larger file)",
+		}
+		presetValues = []string{"6", "4", "8"}
+	} else {
+		presetOptions = []string{
+			"medium (Default — Balanced speed and compression)",
+			"slow (Better compression, ~2x longer encode)",
+			"fast (Faster encode, ~5-10% larger file)",
 		}
+		presetValues = []string{"medium", "slow", "fast"}
+	}
+
+	presetIdx, err := utils.PromptSelect("Select encoder speed preset", presetOptions)
+	if err != nil || presetIdx < 0 {
+		utils.PrintInfo("Optimization cancelled")
+		return false
+	}
+	opts.Preset = presetValues[presetIdx]
 
-		colorProfile := "8-bit SDR"
-		if res.ToneMapped {
-			colorProfile = "Tone-mapped to 8-bit SDR"
+	// A batch has no single source to check for HDR, so it keeps the
+	// automatic tone-mapping.
+	if data == nil {
+		return true
+	}
+	var primaryVideo *videohandlers.Stream
+	for _, s := range data.Streams {
+		if s.CodecType == "video" {
+			primaryVideo = &s
+			break
+		}
+	}
+	if primaryVideo != nil && videohandlers.IsHDRStream(*primaryVideo) {
+		hdrOptions := []string{
+			"Tone-map HDR to SDR 8-bit (Default — Prevents washed-out colors)",
+			"Direct 8-bit conversion without tone mapping",
+		}
+		hdrIdx, err := utils.PromptSelect("HDR source detected: Select color processing", hdrOptions)
+		if err != nil || hdrIdx < 0 {
+			utils.PrintInfo("Optimization cancelled")
+			return false
 		}
+		if hdrIdx == 0 {
+			opts.ToneMap = "yes"
+		} else {
+			opts.ToneMap = "no"
+		}
+	}
+	return true
+}
+
+func printOptimizeResult(res *videohandlers.OptimizeResult) {
+	savedBytes := res.InputBytes - res.OutputBytes
+	savedPct := 0.0
+	if res.InputBytes > 0 {
+		savedPct = float64(savedBytes) / float64(res.InputBytes) * 100
+	}
+
+	outputBase := filepath.Base(res.OutputFile)
+	utils.PrintSuccess(fmt.Sprintf("Optimized %s in %s (saved %.1f%%)", outputBase, res.TimeTaken.Round(time.Second), savedPct))
 
-		codecDisplay := strings.ToUpper(res.Codec)
-		if res.Codec == "hevc" {
-			codecDisplay = "H.265 (HEVC)"
-		} else if res.Codec == "av1" {
-			codecDisplay = "AV1 (libsvtav1)"
+	resStr := fmt.Sprintf("%dx%d", res.OrigWidth, res.OrigHeight)
+	if res.Scaled {
+		resStr += fmt.Sprintf(" → %s", res.TargetRes)
+	} else {
+		resStr += " (retained)"
+	}
+
+	spaceSavedStr := fmt.Sprintf("%s (%.1f%%)", videohandlers.FormatSize(float64(savedBytes)), savedPct)
+	if savedBytes < 0 {
+		spaceSavedStr = fmt.Sprintf("+%s", videohandlers.FormatSize(float64(-savedBytes)))
+	}
+
+	colorProfile := "8-bit SDR"
+	if res.ToneMapped {
+		colorProfile = "Tone-mapped to 8-bit SDR"
+	}
+
+	codecDisplay := strings.ToUpper(res.Codec)
+	if res.Codec == "hevc" {
+		codecDisplay = "H.265 (HEVC)"
+	} else if res.Codec == "av1" {
+		codecDisplay = "AV1 (libsvtav1)"
+	}
+
+	rateRow := []string{"CRF / Preset", fmt.Sprintf("%d / %s", res.CRF, res.Preset)}
+	if res.QualityMetric != "" {
+		score := fmt.Sprintf("VMAF %.2f", res.QualityScore)
+		if res.QualityMetric == "ssim" {
+			score = fmt.Sprintf("SSIM %.4f", res.QualityScore)
 		}
+		rateRow[1] += fmt.Sprintf(" (searched, sampled %s)", score)
+	} else if res.VideoBitrate > 0 {
+		rateRow = []string{"Bitrate / Preset", fmt.Sprintf("%s (two-pass) / %s", videohandlers.FormatBitrate(float64(res.VideoBitrate)), res.Preset)}
+	}
 
-		utils.PrintTable([]string{"Property", "Value"}, [][]string{
-			{"Input Size", videohandlers.FormatSize(float64(res.InputBytes))},
-			{"Optimized Size", videohandlers.FormatSize(float64(res.OutputBytes))},
-			{"Space Saved", spaceSavedStr},
-			{"Codec", codecDisplay},
-			{"Resolution", resStr},
-			{"CRF / Preset", fmt.Sprintf("%d / %s", res.CRF, res.Preset)},
-			{"Color Format", colorProfile},
-			{"Duration", videohandlers.FormatDuration(res.DurationSec)},
-			{"Output File", res.OutputFile},
-		})
-	},
+	rows := [][]string{
+		{"Input Size", videohandlers.FormatSize(float64(res.InputBytes))},
+		{"Optimized Size", videohandlers.FormatSize(float64(res.OutputBytes))},
+		{"Space Saved", spaceSavedStr},
+		{"Codec", codecDisplay},
+		{"Resolution", resStr},
+		rateRow,
+		{"Color Format", colorProfile},
+		{"Tracks", fmt.Sprintf("%d audio, %d subtitle", res.AudioStreams, res.SubtitleStreams)},
+		{"Duration", videohandlers.FormatDuration(res.DurationSec)},
+		{"Output File", res.OutputFile},
+	}
+	if res.TargetSize > 0 {
+		landed := float64(res.OutputBytes) / float64(res.TargetSize) * 100
+		rows = slices.Insert(rows, 2, []string{"Target Size", fmt.Sprintf("%s (output is %.1f%%)", videohandlers.FormatSize(float64(res.TargetSize)), landed)})
+	}
+	utils.PrintTable([]string{"Property", "Value"}, rows)
 }
 
 func init() {
 	videoOptimizeCmd.Flags().StringVarP(&videoOptimizeFlags.codec, "codec", "c", "hevc", "Video codec: hevc (default) or av1")
+	videoOptimizeCmd.Flags().StringVarP(&videoOptimizeFlags.profile, "profile", "p", "", "Named settings profile: archive, phone, lecture, or one from ~/.config/nits/"+videohandlers.ProfilesFileName)
 	videoOptimizeCmd.Flags().BoolVarP(&videoOptimizeFlags.manual, "manual", "m", false, "Interactively choose codec, CRF, resolution, audio, and preset options")
+	videoOptimizeCmd.Flags().StringVar(&videoOptimizeFlags.size, "target-size", "", "Two-pass encode to fit this size instead of using CRF (e.g., '500MB', '1.5G')")
+	videoOptimizeCmd.Flags().StringVar(&videoOptimizeFlags.bitrate, "target-bitrate", "", "Two-pass encode at this video bitrate instead of using CRF (e.g., '2500k', '4M')")
+	videoOptimizeCmd.Flags().Float64Var(&videoOptimizeFlags.vmaf, "target-vmaf", 0, "Pick the highest CRF whose sampled VMAF meets this score (e.g., 93)")
+	videoOptimizeCmd.Flags().Float64Var(&videoOptimizeFlags.ssim, "target-ssim", 0, "Pick the highest CRF whose sampled SSIM meets this score (e.g., 0.98)")
+	videoOptimizeCmd.MarkFlagsMutuallyExclusive("target-size", "target-bitrate", "target-vmaf", "target-ssim")
+	videoOptimizeCmd.Flags().StringVar(&videoOptimizeFlags.container, "container", "mp4", "Output container: mp4 (default) or mkv")
+	videoOptimizeCmd.Flags().StringVar(&videoOptimizeFlags.audio, "audio", "", "Audio tracks to keep: all, none, or lang:eng,jpn, copied as-is into mkv (default: one main track, AAC)")
+	videoOptimizeCmd.Flags().StringVar(&videoOptimizeFlags.subs, "subs", "", "Subtitle tracks to keep: all (default), none, or lang:eng,jpn")
+	videoOptimizeCmd.Flags().BoolVarP(&videoOptimizeFlags.recursive, "recursive", "r", false, "With a directory, also optimize videos in its subdirectories")
+	videoOptimizeCmd.Flags().IntVarP(&videoOptimizeFlags.jobs, "jobs", "j", 1, "With a directory, number of videos to encode at once")
+	videoOptimizeCmd.Flags().StringVar(&videoOptimizeFlags.queue, "queue", "", "With a directory, queue file to record progress in (default: <dir>/"+videohandlers.DefaultQueueFile+")")
 	rootCmd.AddCommand(videoOptimizeCmd)
 }
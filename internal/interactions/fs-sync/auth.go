@@ -0,0 +1,300 @@
+package fssync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	authHeader = "X-Nits-Auth"
+
+	// authWindow bounds clock skew between peers and how long a used nonce
+	// must be remembered to reject replays.
+	authWindow = 5 * time.Minute
+
+	// maxSignedBody caps the requests, such as /done, whose whole body the
+	// server reads to check its signature.
+	maxSignedBody = 64 << 20
+
+	// pairingAlphabet omits 0/O and 1/I/L so codes survive being read aloud.
+	pairingAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+)
+
+// GeneratePairingCode returns a random code of the form XXXX-XXXX for a
+// server to print and a client to present.
+func GeneratePairingCode() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(pairingAlphabet)))
+	for i := range 8 {
+		if i == 4 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate pairing code: %w", err)
+		}
+		b.WriteByte(pairingAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// normalizeCode makes codes case-insensitive and ignores separators, so
+// "abcd efgh" and "ABCD-EFGH" are the same key.
+func normalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// requestMAC signs the session, method, path, query, timestamp, nonce and
+// body digest with key, so the key itself never crosses the wire.
+func requestMAC(key, session, method, uri, ts, nonce, digest string) string {
+	mac := hmac.New(sha256.New, []byte(normalizeCode(key)))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s", session, method, uri, ts, nonce, digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionKey derives the secret a paired client signs with from the pairing
+// code and both sides' nonces, so it never crosses the wire either.
+func sessionKey(code, clientNonce, session string) string {
+	mac := hmac.New(sha256.New, []byte(normalizeCode(code)))
+	fmt.Fprintf(mac, "nits-pair\n%s\n%s", clientNonce, session)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// digestFor is what the MAC covers of a request's body. File uploads are
+// streamed, so for them it is the declared X-Nits-Sha256, which the server
+// checks the received file against before committing it; any other body is
+// hashed whole.
+func digestFor(header http.Header, body []byte) string {
+	if hash := header.Get(hashHeader); hash != "" {
+		return "file=" + hash
+	}
+	sum := sha256.Sum256(body)
+	return "body=" + hex.EncodeToString(sum[:])
+}
+
+// signRequest signs req with key. session is empty when key is the pairing
+// code itself, which only /pair accepts.
+func signRequest(req *http.Request, key, session string) error {
+	var body []byte
+	if req.Header.Get(hashHeader) == "" && req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return errors.New("cannot sign a streamed request body")
+		}
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	nonce, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := requestMAC(key, session, req.Method, req.URL.RequestURI(), ts, nonce, digestFor(req.Header, body))
+	req.Header.Set(authHeader, session+"."+ts+"."+nonce+"."+mac)
+	return nil
+}
+
+// authSession is what a client holds after redeeming its pairing code.
+type authSession struct {
+	id  string
+	key string
+}
+
+// authTransport signs outgoing requests with the client's session once it
+// has paired, and with the pairing code before that.
+type authTransport struct {
+	base    http.RoundTripper
+	code    string
+	session atomic.Pointer[authSession]
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	key, id := t.code, ""
+	if sess := t.session.Load(); sess != nil {
+		key, id = sess.key, sess.id
+	}
+	if err := signRequest(signed, key, id); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(signed)
+}
+
+// pair redeems the pairing code over client, which must sign with t, for a
+// session of its own. The server accepts each code once.
+func (t *authTransport) pair(client *http.Client, serverAddr string) error {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	reqBody, _ := json.Marshal(PairRequest{Nonce: nonce})
+	resp, err := client.Post(serverAddr+"/pair", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			return errors.New("server rejected the pairing code (wrong, or already used)")
+		}
+		return statusError(resp.StatusCode)
+	}
+	var pairResp PairResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pairResp); err != nil {
+		return err
+	}
+	if pairResp.Session == "" {
+		return errors.New("server returned no session")
+	}
+	t.session.Store(&authSession{id: pairResp.Session, key: sessionKey(t.code, nonce, pairResp.Session)})
+	return nil
+}
+
+// requestVerifier checks signed requests on the server and remembers nonces
+// for the length of the window so a captured header cannot be replayed. The
+// pairing code is only good for one /pair request, which turns it into a
+// session key for that client; after that the code is rejected.
+type requestVerifier struct {
+	mu        sync.Mutex
+	code      string
+	sessions  map[string]string
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newRequestVerifier(code string) *requestVerifier {
+	return &requestVerifier{code: code, sessions: make(map[string]string), nonces: make(map[string]time.Time)}
+}
+
+// verify accepts a request signed with the key of a paired session.
+func (v *requestVerifier) verify(r *http.Request) bool {
+	session, _, _, ok := v.check(r, func(id string) string { return v.sessions[id] })
+	return ok && session != ""
+}
+
+// pair redeems the pairing code: it accepts a /pair request signed with the
+// current code, consumes the code and returns the new session's ID.
+func (v *requestVerifier) pair(r *http.Request) (string, bool) {
+	session, code, body, ok := v.check(r, func(id string) string {
+		if id != "" {
+			return ""
+		}
+		return v.code
+	})
+	if !ok || session != "" {
+		return "", false
+	}
+	var pairReq PairRequest
+	if err := json.Unmarshal(body, &pairReq); err != nil || pairReq.Nonce == "" {
+		return "", false
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return "", false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Another client may have redeemed the code since it was checked.
+	if v.code != code {
+		return "", false
+	}
+	v.sessions[id] = sessionKey(code, pairReq.Nonce, id)
+	v.code = ""
+	return id, true
+}
+
+// setCode makes code the one the next /pair request must present.
+func (v *requestVerifier) setCode(code string) {
+	v.mu.Lock()
+	v.code = code
+	v.mu.Unlock()
+}
+
+// check verifies r's signature against the key keyFor returns for its
+// session ID, called with v.mu held, and returns that ID, the key and the
+// body it read. An empty key never verifies.
+func (v *requestVerifier) check(r *http.Request, keyFor func(session string) string) (session, key string, body []byte, ok bool) {
+	parts := strings.Split(r.Header.Get(authHeader), ".")
+	if len(parts) != 4 {
+		return "", "", nil, false
+	}
+	session, ts, nonce, mac := parts[0], parts[1], parts[2], parts[3]
+	v.mu.Lock()
+	key = keyFor(session)
+	v.mu.Unlock()
+	if key == "" {
+		return "", "", nil, false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", "", nil, false
+	}
+	now := time.Now()
+	sent := time.Unix(unix, 0)
+	if sent.Before(now.Add(-authWindow)) || sent.After(now.Add(authWindow)) {
+		return "", "", nil, false
+	}
+	// Bodies signed by their own hash are small JSON documents, read here in
+	// full and handed on to the handler.
+	if r.Header.Get(hashHeader) == "" {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil || len(body) > maxSignedBody {
+			return "", "", nil, false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	want := requestMAC(key, session, r.Method, r.URL.RequestURI(), ts, nonce, digestFor(r.Header, body))
+	if !hmac.Equal([]byte(mac), []byte(want)) {
+		return "", "", nil, false
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.lastSweep) > authWindow {
+		for seen, at := range v.nonces {
+			if now.Sub(at) > 2*authWindow {
+				delete(v.nonces, seen)
+			}
+		}
+		v.lastSweep = now
+	}
+	if _, replayed := v.nonces[nonce]; replayed {
+		return "", "", nil, false
+	}
+	v.nonces[nonce] = now
+	return session, key, body, true
+}
@@ -0,0 +1,476 @@
+package fssync
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// bundleIndexName is the first entry of every bundle.
+	bundleIndexName = "nits-bundle.json"
+
+	// bundleFilePrefix holds file contents, keyed by their manifest path.
+	bundleFilePrefix = "files/"
+
+	bundleVersion = 1
+)
+
+// errStopBundle ends a bundle walk early without reporting an error.
+var errStopBundle = errors.New("stop reading bundle")
+
+// bundleIndex carries the exporting side's full manifest, so the importing
+// side can compare against it exactly as a client compares against a
+// server's, and lists the files whose contents follow.
+type bundleIndex struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Manifest *ManifestResponse `json:"manifest"`
+	Files    []string          `json:"files"`
+}
+
+// bundleWriter adds entries to a tar, gzipped tar or zip archive.
+type bundleWriter interface {
+	add(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type tarBundle struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (b *tarBundle) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(b.tw, r)
+	return err
+}
+
+func (b *tarBundle) Close() error {
+	err := b.tw.Close()
+	if b.gz != nil {
+		if gzErr := b.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
+
+type zipBundle struct {
+	zw *zip.Writer
+}
+
+func (b *zipBundle) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	method := zip.Deflate
+	if !compressible(name) {
+		method = zip.Store
+	}
+	w, err := b.zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (b *zipBundle) Close() error {
+	return b.zw.Close()
+}
+
+func isZipBundle(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".zip")
+}
+
+// newBundleWriter picks the archive format from the file name: .zip, .tar.gz
+// or .tgz for a gzipped tar, and a plain tar otherwise.
+func newBundleWriter(w io.Writer, path string) bundleWriter {
+	lower := strings.ToLower(path)
+	switch {
+	case isZipBundle(path):
+		return &zipBundle{zw: zip.NewWriter(w)}
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		gz := gzip.NewWriter(w)
+		return &tarBundle{tw: tar.NewWriter(gz), gz: gz}
+	}
+	return &tarBundle{tw: tar.NewWriter(w)}
+}
+
+// readBundle calls fn for each entry in archive order until fn returns an
+// error; errStopBundle stops early without one. Gzipped tars are detected
+// from their contents.
+func readBundle(path string, fn func(name string, r io.Reader) error) error {
+	if isZipBundle(path) {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return ignoreStop(err)
+			}
+		}
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return ignoreStop(err)
+		}
+	}
+}
+
+func ignoreStop(err error) error {
+	if errors.Is(err, errStopBundle) {
+		return nil
+	}
+	return err
+}
+
+func decodeBundleIndex(r io.Reader) (*bundleIndex, error) {
+	var index bundleIndex
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid bundle index: %w", err)
+	}
+	if index.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", index.Version)
+	}
+	if index.Manifest == nil || index.Manifest.Files == nil {
+		return nil, errors.New("bundle index has no manifest")
+	}
+	if index.Manifest.Meta == nil {
+		index.Manifest.Meta = make(map[string]FileMeta)
+	}
+	return &index, nil
+}
+
+// readBundleIndex reads just the index of a bundle.
+func readBundleIndex(path string) (*bundleIndex, error) {
+	var index *bundleIndex
+	err := readBundle(path, func(name string, r io.Reader) error {
+		if name != bundleIndexName {
+			return errors.New("not a nits bundle: index missing")
+		}
+		var err error
+		if index, err = decodeBundleIndex(r); err != nil {
+			return err
+		}
+		return errStopBundle
+	})
+	if err == nil && index == nil {
+		err = errors.New("not a nits bundle: index missing")
+	}
+	return index, err
+}
+
+// Export writes a bundle holding this side's manifest and the files that the
+// side which exported againstPath lacks or holds in another version, for
+// syncing machines that cannot reach each other. Without againstPath every
+// file is included; with manifestOnly none are, which produces the bundle
+// the other side exports against.
+func (c *Client) Export(bundlePath, againstPath string, manifestOnly bool, cb ClientCallbacks) error {
+	return c.session(cb, func(cb ClientCallbacks) error {
+		c.report.Mode = "export"
+		localManifest, err := c.localManifest()
+		if err != nil {
+			return fmt.Errorf("failed to build local manifest: %w", err)
+		}
+		remote := &ManifestResponse{Files: map[string]string{}, Meta: map[string]FileMeta{}}
+		if againstPath != "" {
+			index, err := readBundleIndex(againstPath)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", againstPath, err)
+			}
+			remote = c.filterManifest(index.Manifest)
+		}
+		var toSend []string
+		if !manifestOnly {
+			toSend, _ = c.compareManifests(localManifest.Files, remote.Files)
+			slices.Sort(toSend)
+		}
+		if c.cfg.DryRun {
+			for _, path := range toSend {
+				cb.generic(fmt.Sprintf("Dry Run: %s", path))
+				c.report.skipped(path)
+			}
+			cb.success(fmt.Sprintf("%d file(s) would be exported", len(toSend)))
+			return nil
+		}
+		return c.writeBundle(bundlePath, localManifest, toSend, cb)
+	})
+}
+
+// writeBundle writes to a partial file and renames it into place, so an
+// interrupted export never leaves a bundle that looks complete.
+func (c *Client) writeBundle(bundlePath string, manifest *ManifestResponse, paths []string, cb ClientCallbacks) error {
+	tmpPath := partialPath(bundlePath)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	bw := newBundleWriter(f, bundlePath)
+	err = c.writeBundleEntries(bw, manifest, paths, cb)
+	if closeErr := bw.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, bundlePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	cb.success(fmt.Sprintf("%d file(s) exported to %s (%s)", len(paths), bundlePath, formatBytes(c.stats.raw.Load())))
+	return nil
+}
+
+func (c *Client) writeBundleEntries(bw bundleWriter, manifest *ManifestResponse, paths []string, cb ClientCallbacks) error {
+	index, err := json.Marshal(bundleIndex{
+		Version:  bundleVersion,
+		Created:  time.Now().UTC(),
+		Manifest: manifest,
+		Files:    paths,
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.add(bundleIndexName, int64(len(index)), time.Now(), bytes.NewReader(index)); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		// Symlinks travel as their manifest entry alone.
+		if manifest.Meta[path].Link != "" {
+			cb.itemSuccess(fmt.Sprintf("Exported (symlink): %s", path))
+			c.report.sent(path, 0)
+			continue
+		}
+		if err := c.addBundleFile(bw, path); err != nil {
+			return fmt.Errorf("failed to add %s: %w", path, err)
+		}
+		cb.itemSuccess(fmt.Sprintf("Exported: %s", path))
+		c.report.sent(path, 0)
+	}
+	return nil
+}
+
+func (c *Client) addBundleFile(bw bundleWriter, path string) error {
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// A file that changes after the manifest was built fails the importer's
+	// checksum check rather than being applied half-written.
+	r := io.LimitReader(f, info.Size())
+	if err := bw.add(bundleFilePrefix+path, info.Size(), info.ModTime(), r); err != nil {
+		return err
+	}
+	c.stats.raw.Add(info.Size())
+	return nil
+}
+
+// Import applies a bundle written by Export exactly as a pull from a server
+// holding the exporter's files: changed files are replaced, metadata is
+// applied and, with DeleteExtra, files the exporter lacks are deleted.
+func (c *Client) Import(bundlePath string, cb ClientCallbacks) error {
+	return c.session(cb, func(cb ClientCallbacks) error {
+		c.report.Mode = "import"
+		localManifest, err := c.localManifest()
+		if err != nil {
+			return fmt.Errorf("failed to build local manifest: %w", err)
+		}
+		var source *ManifestResponse
+		var toRequest, toDelete []string
+		pending := make(map[string]bool)
+		var synced []string
+		err = readBundle(bundlePath, func(name string, r io.Reader) error {
+			if source == nil {
+				if name != bundleIndexName {
+					return errors.New("not a nits bundle: index missing")
+				}
+				index, err := decodeBundleIndex(r)
+				if err != nil {
+					return err
+				}
+				source = c.filterManifest(index.Manifest)
+				toRequest, toDelete = c.compareManifests(source.Files, localManifest.Files)
+				toDelete = notHeldBy(toDelete, index.Manifest)
+				slices.Sort(toRequest)
+				if c.cfg.DryRun {
+					return errStopBundle
+				}
+				for _, path := range toRequest {
+					pending[path] = true
+				}
+				return nil
+			}
+			path, ok := strings.CutPrefix(name, bundleFilePrefix)
+			if !ok || !pending[path] {
+				return nil
+			}
+			delete(pending, path)
+			_, exists := localManifest.Files[path]
+			if err := c.importFile(path, source.Files[path], r); err != nil {
+				cb.warn(fmt.Sprintf("Failed to import %s", path), err)
+				c.report.failed(path, err)
+				return nil
+			}
+			cb.itemSuccess(fmt.Sprintf("Synced: %s", path))
+			c.report.transferred(path, exists)
+			synced = append(synced, path)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if source == nil {
+			return errors.New("not a nits bundle: index missing")
+		}
+		if c.cfg.DryRun {
+			return c.reportDryRun(toRequest, toDelete, cb)
+		}
+
+		for _, path := range slices.Sorted(maps.Keys(pending)) {
+			_, exists := localManifest.Files[path]
+			if link := source.Meta[path].Link; link != "" {
+				if err := c.pullSymlink(path, link); err != nil {
+					cb.warn(fmt.Sprintf("Failed to create symlink %s", path), err)
+					c.report.failed(path, err)
+					continue
+				}
+				cb.itemSuccess(fmt.Sprintf("Synced (symlink): %s", path))
+				c.report.transferred(path, exists)
+				synced = append(synced, path)
+				continue
+			}
+			// The bundle was exported against an older manifest of this side.
+			err := errors.New("not in bundle; export again against a current manifest")
+			cb.warn(fmt.Sprintf("Failed to import %s", path), err)
+			c.report.failed(path, err)
+		}
+		current := maps.Clone(source.Files)
+		for _, path := range toRequest {
+			delete(current, path)
+		}
+		c.applyServerMeta(append(slices.Collect(maps.Keys(current)), synced...), source, cb)
+		var deleted []string
+		if c.cfg.DeleteExtra && len(toDelete) > 0 {
+			deleted, _ = c.deleteLocalFiles(toDelete, cb)
+		}
+		totalCount := len(synced) + len(deleted)
+		if totalCount == 0 {
+			cb.warn("no files were synced", nil)
+		} else {
+			cb.success(fmt.Sprintf("%d file(s) synced", totalCount))
+		}
+		return nil
+	})
+}
+
+// reportDryRun lists what an import would change.
+func (c *Client) reportDryRun(toRequest, toDelete []string, cb ClientCallbacks) error {
+	for _, path := range toRequest {
+		cb.generic(fmt.Sprintf("Dry Run: %s", path))
+		c.report.skipped(path)
+	}
+	totalCount := len(toRequest)
+	if c.cfg.DeleteExtra {
+		for _, path := range toDelete {
+			cb.generic(fmt.Sprintf("Dry Run (delete): %s", path))
+			c.report.skipped(path)
+		}
+		totalCount += len(toDelete)
+	}
+	if totalCount == 0 {
+		cb.warn("no files would be synced", nil)
+	} else {
+		cb.success(fmt.Sprintf("%d file(s) would be synced", totalCount))
+	}
+	return nil
+}
+
+// importFile writes one bundled file through a partial file and commits it
+// once it matches the exporter's hash.
+func (c *Client) importFile(path, wantHash string, r io.Reader) error {
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	f, err := openPartial(fullPath, 0)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	c.stats.raw.Add(n)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath(fullPath))
+		return err
+	}
+	return commitPartial(fullPath, wantHash, c.trash)
+}
@@ -0,0 +1,149 @@
+package fssync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ManifestCache remembers file hashes keyed by path, size and mtime so that
+// BuildManifest only re-reads files that changed since the previous run.
+type ManifestCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+func getCacheDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	cacheDir := filepath.Join(homeDir, ".config", "nits", "fs-sync-cache")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	return cacheDir, nil
+}
+
+// LoadManifestCache opens the cache for rootDir under ~/.config/nits. With
+// rehash the stored hashes are discarded so every file is read again; the
+// fresh results are still saved for the next run.
+func LoadManifestCache(rootDir string, rehash bool) (*ManifestCache, error) {
+	absDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(absDir))
+	mc := &ManifestCache{
+		path:    filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+".json"),
+		entries: make(map[string]cacheEntry),
+	}
+	if rehash {
+		return mc, nil
+	}
+	data, err := os.ReadFile(mc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mc, nil
+		}
+		return nil, err
+	}
+	// A corrupt cache only costs a rehash, so start empty instead of failing.
+	if err := json.Unmarshal(data, &mc.entries); err != nil || mc.entries == nil {
+		mc.entries = make(map[string]cacheEntry)
+	}
+	return mc, nil
+}
+
+func (mc *ManifestCache) lookup(relPath string, info fs.FileInfo) (string, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	entry, ok := mc.entries[relPath]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+func (mc *ManifestCache) store(relPath string, info fs.FileInfo, hash string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.entries[relPath] = cacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hash,
+	}
+}
+
+// prune drops entries for files that no longer appear in manifest.
+func (mc *ManifestCache) prune(manifest map[string]string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for relPath := range mc.entries {
+		if _, ok := manifest[relPath]; !ok {
+			delete(mc.entries, relPath)
+		}
+	}
+}
+
+func (mc *ManifestCache) Save() error {
+	mc.mu.Lock()
+	data, err := json.Marshal(mc.entries)
+	mc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(mc.path, data, 0644)
+}
+
+// baseManifestPath names the file holding the manifest both sides agreed on
+// after the last two-way sync between syncDir and serverAddr.
+func baseManifestPath(syncDir, serverAddr string) (string, error) {
+	absDir, err := filepath.Abs(syncDir)
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(absDir + "\n" + serverAddr))
+	return filepath.Join(cacheDir, "base-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadBaseManifest returns an empty manifest when there is no usable base,
+// which makes every differing path a conflict rather than an overwrite.
+func loadBaseManifest(path string) map[string]string {
+	base := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return base
+	}
+	if err := json.Unmarshal(data, &base); err != nil || base == nil {
+		return make(map[string]string)
+	}
+	return base
+}
+
+func saveBaseManifest(path string, manifest map[string]string) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
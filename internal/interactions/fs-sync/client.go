@@ -2,22 +2,36 @@ package fssync
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"time"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	u "github.com/tanq16/nits/utils"
 )
 
+// ClientCallbacks report sync progress. With Parallel above one they are
+// called from several goroutines at once.
 type ClientCallbacks struct {
-	OnInfo        func(msg string)
-	OnGeneric     func(msg string)
-	OnItemSuccess func(msg string)
-	OnWarn        func(msg string, err error)
-	OnSuccess     func(msg string)
-	OnError       func(msg string, err error)
+	OnInfo         func(msg string)
+	OnGeneric      func(msg string)
+	OnItemSuccess  func(msg string)
+	OnWarn         func(msg string, err error)
+	OnSuccess      func(msg string)
+	OnError        func(msg string, err error)
+	OnProgress     func(label string, percent int)
+	OnProgressDone func()
+	OnReport       func(report *SyncReport)
 }
 
 func (cb ClientCallbacks) info(msg string) {
@@ -56,19 +70,58 @@ func (cb ClientCallbacks) err(msg string, err error) {
 	}
 }
 
+func (cb ClientCallbacks) progress(label string, percent int) {
+	if cb.OnProgress != nil {
+		cb.OnProgress(label, percent)
+	}
+}
+
+func (cb ClientCallbacks) progressDone() {
+	if cb.OnProgressDone != nil {
+		cb.OnProgressDone()
+	}
+}
+
+func (cb ClientCallbacks) report(report *SyncReport) {
+	if cb.OnReport != nil {
+		cb.OnReport(report)
+	}
+}
+
 type ClientConfig struct {
-	ServerAddr  string
-	SyncDir     string
-	DeleteExtra bool
-	Insecure    bool
-	DryRun      bool
-	IgnorePaths string
+	ServerAddr         string
+	SyncDir            string
+	DeleteExtra        bool
+	Insecure           bool
+	DryRun             bool
+	IgnorePaths        string
+	Gitignore          bool
+	Delta              bool
+	Rehash             bool
+	PairingCode        string
+	Fingerprint        string
+	Parallel           int
+	BWLimit            int64
+	BackupDir          string
+	Filter             Filter
+	RemotePath         string
+	DisableCompression bool
 }
 
 type Client struct {
 	cfg        ClientConfig
 	httpClient *http.Client
 	ignorer    *PathIgnorer
+	filter     *manifestFilter
+	cache      *ManifestCache
+	gzip       bool
+	stats      transferStats
+	report     *SyncReport
+	trash      *Trash
+	limiter    *rateLimiter
+	auth       *authTransport
+	progress   atomic.Int64
+	plan       atomic.Pointer[string]
 }
 
 func NewClient(cfg ClientConfig) (*Client, error) {
@@ -77,53 +130,138 @@ func NewClient(cfg ClientConfig) (*Client, error) {
 		return nil, fmt.Errorf("failed to resolve sync directory: %w", err)
 	}
 	cfg.SyncDir = absDir
+	if cfg.RemotePath, err = cleanRemotePath(cfg.RemotePath); err != nil {
+		return nil, fmt.Errorf("invalid remote path: %w", err)
+	}
 	if err := os.MkdirAll(cfg.SyncDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create sync directory: %w", err)
 	}
-	transport := &http.Transport{}
-	if cfg.Insecure {
+	// No overall client timeout: transfers are streamed and may legitimately
+	// take a long time for large files.
+	transport := &http.Transport{ResponseHeaderTimeout: requestTimeout}
+	if cfg.Fingerprint != "" {
+		transport.TLSClientConfig = u.PinnedTLSConfig(cfg.Fingerprint)
+	} else if cfg.Insecure {
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
-	return &Client{
-		cfg: cfg,
-		httpClient: &http.Client{
-			Timeout:   5 * time.Minute,
-			Transport: transport,
-		},
-		ignorer: NewPathIgnorer(cfg.IgnorePaths),
-	}, nil
+	var roundTripper http.RoundTripper = transport
+	var auth *authTransport
+	if cfg.PairingCode != "" {
+		auth = &authTransport{base: transport, code: cfg.PairingCode}
+		roundTripper = auth
+	}
+	ignorer, err := LoadPathIgnorer(cfg.SyncDir, cfg.IgnorePaths, cfg.Gitignore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	if err := ignoreBackupDir(ignorer, cfg.SyncDir, cfg.BackupDir); err != nil {
+		return nil, err
+	}
+	// Without a usable cache every run simply hashes the whole tree.
+	cache, err := LoadManifestCache(cfg.SyncDir, cfg.Rehash)
+	if err != nil {
+		cache = nil
+	}
+	c := &Client{
+		cfg:     cfg,
+		ignorer: ignorer,
+		filter:  newManifestFilter(cfg.Filter),
+		cache:   cache,
+		limiter: newRateLimiter(cfg.BWLimit),
+		auth:    auth,
+	}
+	// The transport tags requests with the client's ID and plan so the server
+	// can tell clients apart and report their progress.
+	c.httpClient = &http.Client{Transport: &clientTransport{base: roundTripper, id: newClientID(), plan: &c.plan}}
+	return c, nil
 }
 
+// Run performs one sync and hands its report to cb.OnReport, including when
+// the sync fails. Local files it deletes or overwrites are kept in a new
+// backup session when BackupDir is set.
 func (c *Client) Run(cb ClientCallbacks) error {
-	mode, err := c.fetchMode()
+	return c.session(cb, c.run)
+}
+
+// session wraps one sync, over the network or through a bundle, with a fresh
+// report and backup session.
+func (c *Client) session(cb ClientCallbacks, sync func(cb ClientCallbacks) error) error {
+	c.report = newSyncReport("client", "", c.cfg.DryRun)
+	c.trash = newTrash(c.cfg.SyncDir, c.cfg.BackupDir)
+	c.plan.Store(nil)
+	c.stats.reset()
+	err := sync(cb)
+	if err != nil {
+		c.report.failed("", err)
+	}
+	if dir, closeErr := c.trash.close(); closeErr != nil {
+		cb.warn("Failed to record backup session", closeErr)
+	} else if dir != "" {
+		cb.info(fmt.Sprintf("Backup session saved to %s", dir))
+	}
+	if n := len(c.report.Mismatches); n > 0 {
+		cb.warn(fmt.Sprintf("%d file(s) failed checksum verification and were discarded", n), nil)
+	}
+	c.report.Bytes, c.report.WireBytes = c.stats.raw.Load(), c.stats.wire.Load()
+	c.report.finish()
+	cb.report(c.report)
+	return err
+}
+
+func (c *Client) run(cb ClientCallbacks) error {
+	modeResp, err := c.fetchMode()
 	if err != nil {
 		return fmt.Errorf("failed to detect server mode: %w", err)
 	}
+	if modeResp.Auth && c.cfg.PairingCode == "" {
+		return errors.New("server requires a pairing code (use --code)")
+	}
+	// The code is redeemed once; later runs, as in watch mode, reuse the session.
+	if modeResp.Auth && c.auth.session.Load() == nil {
+		if err := c.auth.pair(c.httpClient, c.cfg.ServerAddr); err != nil {
+			return fmt.Errorf("failed to pair: %w", err)
+		}
+	}
+	c.gzip = !c.cfg.DisableCompression && slices.Contains(modeResp.Compression, encodingGzip)
+	mode := modeResp.Mode
+	c.report.Mode = mode
 	cb.info(fmt.Sprintf("Server mode: %s", mode))
 	switch mode {
 	case "send":
 		return c.pullFromServer(cb)
 	case "receive":
 		return c.pushToServer(cb)
+	case "both":
+		return c.mergeWithServer(cb)
 	default:
 		return fmt.Errorf("unknown server mode: %s", mode)
 	}
 }
 
-func (c *Client) fetchMode() (string, error) {
+func (c *Client) fetchMode() (*ModeResponse, error) {
 	resp, err := c.httpClient.Get(c.cfg.ServerAddr + "/mode")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode)
 	}
 	var modeResp ModeResponse
 	if err := json.NewDecoder(resp.Body).Decode(&modeResp); err != nil {
-		return "", err
+		return nil, err
 	}
-	return modeResp.Mode, nil
+	return &modeResp, nil
+}
+
+func statusError(status int) error {
+	switch status {
+	case http.StatusUnauthorized:
+		return errors.New("server rejected the pairing code")
+	case http.StatusUnprocessableEntity:
+		return fmt.Errorf("server rejected the file: %w", errHashMismatch)
+	}
+	return fmt.Errorf("server returned %d", status)
 }
 
 func (c *Client) pullFromServer(cb ClientCallbacks) error {
@@ -132,23 +270,20 @@ func (c *Client) pullFromServer(cb ClientCallbacks) error {
 		return fmt.Errorf("failed to fetch manifest: %w", err)
 	}
 
-	localManifest, _ := BuildManifest(c.cfg.SyncDir, c.ignorer)
-
-	filteredServer := make(map[string]string, len(serverManifest))
-	for path, hash := range serverManifest {
-		if !c.ignorer.IsIgnored(path) {
-			filteredServer[path] = hash
-		}
-	}
+	localManifest, _ := c.localManifest()
+	filteredServer := c.filterManifest(serverManifest)
 
-	toRequest, toDelete := c.compareManifests(filteredServer, localManifest)
+	toRequest, toDelete := c.compareManifests(filteredServer.Files, localManifest.Files)
+	toDelete = notHeldBy(toDelete, serverManifest)
 	if c.cfg.DryRun {
 		for _, path := range toRequest {
 			cb.generic(fmt.Sprintf("Dry Run: %s", path))
+			c.report.skipped(path)
 		}
 		if c.cfg.DeleteExtra {
 			for _, path := range toDelete {
 				cb.generic(fmt.Sprintf("Dry Run (delete): %s", path))
+				c.report.skipped(path)
 			}
 		}
 		totalCount := len(toRequest)
@@ -160,34 +295,34 @@ func (c *Client) pullFromServer(cb ClientCallbacks) error {
 		} else {
 			cb.success(fmt.Sprintf("%d file(s) would be synced", totalCount))
 		}
-		// Empty /files POST tells the one-shot server to shut down.
-		_, err = c.fetchFiles(nil, cb)
-		return err
+		// /done tells the one-shot server to shut down.
+		return c.sendDone(DoneRequest{})
 	}
 
-	syncedCount := 0
-	if len(toRequest) > 0 {
-		syncedCount, err = c.fetchFiles(toRequest, cb)
-		if err != nil {
-			return fmt.Errorf("failed to fetch files: %w", err)
-		}
-	} else {
-		if _, err = c.fetchFiles(nil, cb); err != nil {
-			return fmt.Errorf("failed to signal server done: %w", err)
-		}
+	synced := c.pullFiles(toRequest, filteredServer, localManifest, cb)
+	syncedCount := len(synced)
+	// Every path, not just the pulled ones, so mode-only changes carry over,
+	// except those that failed to fetch and still hold old content.
+	current := maps.Clone(filteredServer.Files)
+	for _, path := range toRequest {
+		delete(current, path)
 	}
-	deletedCount := 0
+	c.applyServerMeta(append(slices.Collect(maps.Keys(current)), synced...), filteredServer, cb)
+	if err := c.sendDone(DoneRequest{}); err != nil {
+		return fmt.Errorf("failed to signal server done: %w", err)
+	}
+	var deleted []string
 	if c.cfg.DeleteExtra && len(toDelete) > 0 {
-		deletedCount, err = c.deleteLocalFiles(toDelete, cb)
+		deleted, err = c.deleteLocalFiles(toDelete, cb)
 		if err != nil {
 			return fmt.Errorf("failed to delete files: %w", err)
 		}
 	}
-	totalCount := syncedCount + deletedCount
+	totalCount := syncedCount + len(deleted)
 	if totalCount == 0 {
 		cb.warn("no files were synced", nil)
 	} else {
-		cb.success(fmt.Sprintf("%d file(s) synced", totalCount))
+		cb.success(fmt.Sprintf("%d file(s) synced%s", totalCount, c.stats.summary()))
 	}
 	return nil
 }
@@ -198,34 +333,44 @@ func (c *Client) pushToServer(cb ClientCallbacks) error {
 		return fmt.Errorf("failed to fetch server manifest: %w", err)
 	}
 
-	localManifest, err := BuildManifest(c.cfg.SyncDir, c.ignorer)
+	localManifest, err := c.localManifest()
 	if err != nil {
 		return fmt.Errorf("failed to build local manifest: %w", err)
 	}
+	// Paths outside this client's filter must not count as extras to delete,
+	// and the server refuses writes to paths outside its own.
+	serverFiltered := serverManifest
+	serverManifest = c.filterManifest(serverManifest)
 
 	var needed []string
-	for path, localHash := range localManifest {
-		if serverHash, exists := serverManifest[path]; !exists || serverHash != localHash {
+	for path, localHash := range localManifest.Files {
+		if filteredBy(serverFiltered, path) {
+			continue
+		}
+		if serverHash, exists := serverManifest.Files[path]; !exists || serverHash != localHash {
 			needed = append(needed, path)
 		}
 	}
 
 	var toDelete []string
 	if c.cfg.DeleteExtra {
-		for path := range serverManifest {
-			if _, exists := localManifest[path]; !exists {
+		for path := range serverManifest.Files {
+			if _, exists := localManifest.Files[path]; !exists {
 				toDelete = append(toDelete, path)
 			}
 		}
+		toDelete = notHeldBy(toDelete, localManifest)
 	}
 
 	if c.cfg.DryRun {
 		for _, path := range needed {
 			cb.generic(fmt.Sprintf("Dry Run: %s", path))
+			c.report.skipped(path)
 		}
 		if c.cfg.DeleteExtra {
 			for _, path := range toDelete {
 				cb.generic(fmt.Sprintf("Dry Run (delete): %s", path))
+				c.report.skipped(path)
 			}
 		}
 		totalCount := len(needed)
@@ -237,111 +382,549 @@ func (c *Client) pushToServer(cb ClientCallbacks) error {
 		} else {
 			cb.success(fmt.Sprintf("%d file(s) would be synced", totalCount))
 		}
-		// Send empty UploadRequest so the one-shot server shuts down without modifying files.
-		emptyReq := UploadRequest{}
-		reqBody, _ := json.Marshal(emptyReq)
-		resp, err := c.httpClient.Post(
-			c.cfg.ServerAddr+"/upload",
-			"application/json",
-			bytes.NewReader(reqBody),
-		)
-		if err != nil {
+		// Send an empty DoneRequest so the one-shot server shuts down without modifying files.
+		if err := c.sendDone(DoneRequest{}); err != nil {
 			return fmt.Errorf("failed to signal server done: %w", err)
 		}
-		defer resp.Body.Close()
 		return nil
 	}
 
-	var files []FileContent
+	sent := c.pushFiles(needed, localManifest, serverManifest, cb)
+
+	// Always POST /done (even empty) so the one-shot server shuts down.
+	// Metadata goes for every path so the server also picks up mode-only
+	// changes, except those that failed to send and still hold old content.
+	meta := maps.Clone(localManifest.Meta)
 	for _, path := range needed {
-		fullPath := filepath.Join(c.cfg.SyncDir, path)
-		content, err := os.ReadFile(fullPath)
-		if err != nil {
-			cb.warn(fmt.Sprintf("Failed to read %s", path), err)
-			continue
-		}
-		files = append(files, FileContent{Path: path, Content: content})
+		delete(meta, path)
 	}
-
-	// Always POST /upload (even empty) so the one-shot server shuts down.
-	uploadReq := UploadRequest{
-		Files:    files,
-		ToDelete: toDelete,
+	for _, path := range sent {
+		meta[path] = localManifest.Meta[path]
 	}
-	reqBody, _ := json.Marshal(uploadReq)
-	resp, err := c.httpClient.Post(
-		c.cfg.ServerAddr+"/upload",
-		"application/json",
-		bytes.NewReader(reqBody),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to upload files: %w", err)
+	doneReq := DoneRequest{Files: sent, ToDelete: toDelete, Meta: meta, Dirs: localManifest.Dirs}
+	if err := c.sendDone(doneReq); err != nil {
+		return fmt.Errorf("failed to finish upload: %w", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned %d", resp.StatusCode)
+	// The server applies these; its own report records any that failed.
+	for _, path := range toDelete {
+		c.report.deleted(path)
 	}
 
-	if len(files) == 0 && len(toDelete) == 0 {
+	if len(sent) == 0 && len(toDelete) == 0 {
 		cb.warn("no files to send", nil)
 		return nil
 	}
-	for _, file := range files {
-		cb.itemSuccess(fmt.Sprintf("Sent: %s", file.Path))
-	}
-	cb.success(fmt.Sprintf("%d file(s) sent", len(files)))
+	cb.success(fmt.Sprintf("%d file(s) sent%s", len(sent), c.stats.summary()))
 	return nil
 }
 
+// pullFiles fetches paths from the server, trying a delta first for files
+// that already exist locally, and returns the paths that were synced.
+// Symlinks are recreated locally rather than fetched, once every regular
+// file has landed, so no file is written through a link made in this run.
+func (c *Client) pullFiles(paths []string, serverManifest, localManifest *ManifestResponse, cb ClientCallbacks) []string {
+	var files, links []string
+	for _, path := range paths {
+		if serverManifest.Meta[path].Link != "" {
+			links = append(links, path)
+		} else {
+			files = append(files, path)
+		}
+	}
+	total := transferSize(files, serverManifest.Meta)
+	synced := c.transferAll("Pulling", files, total, cb, func(path string) bool {
+		_, exists := localManifest.Files[path]
+		if exists && c.deltaEligible(path) {
+			if err := c.fetchDelta(path, serverManifest.Files[path]); err == nil {
+				c.progress.Add(serverManifest.Meta[path].Size)
+				cb.itemSuccess(fmt.Sprintf("Synced (delta): %s", path))
+				c.report.transferred(path, exists)
+				return true
+			}
+		}
+		if err := c.fetchFile(path, serverManifest.Files[path]); err != nil {
+			cb.warn(fmt.Sprintf("Failed to fetch %s", path), err)
+			c.report.failed(path, err)
+			return false
+		}
+		cb.itemSuccess(fmt.Sprintf("Synced: %s", path))
+		c.report.transferred(path, exists)
+		return true
+	})
+	slices.Sort(links)
+	for _, path := range links {
+		_, exists := localManifest.Files[path]
+		if err := c.pullSymlink(path, serverManifest.Meta[path].Link); err != nil {
+			cb.warn(fmt.Sprintf("Failed to create symlink %s", path), err)
+			c.report.failed(path, err)
+			continue
+		}
+		cb.itemSuccess(fmt.Sprintf("Synced (symlink): %s", path))
+		c.report.transferred(path, exists)
+		synced = append(synced, path)
+	}
+	return synced
+}
 
-func (c *Client) fetchManifest() (map[string]string, error) {
-	resp, err := c.httpClient.Get(c.cfg.ServerAddr + "/manifest")
+// pushFiles uploads paths to the server, trying a delta first for files the
+// server already has, and returns the paths that were sent. Symlinks have no
+// body; the server recreates them from the metadata sent with /done.
+func (c *Client) pushFiles(paths []string, localManifest, serverManifest *ManifestResponse, cb ClientCallbacks) []string {
+	total := transferSize(paths, localManifest.Meta)
+	return c.transferAll("Pushing", paths, total, cb, func(path string) bool {
+		_, exists := serverManifest.Files[path]
+		if localManifest.Meta[path].Link != "" {
+			cb.itemSuccess(fmt.Sprintf("Sent (symlink): %s", path))
+			c.report.transferred(path, exists)
+			return true
+		}
+		if exists && c.deltaEligible(path) {
+			if err := c.uploadDelta(path, localManifest.Files[path]); err == nil {
+				c.progress.Add(localManifest.Meta[path].Size)
+				cb.itemSuccess(fmt.Sprintf("Sent (delta): %s", path))
+				c.report.transferred(path, exists)
+				return true
+			}
+		}
+		if err := c.uploadFile(path, localManifest.Files[path]); err != nil {
+			cb.warn(fmt.Sprintf("Failed to send %s", path), err)
+			c.report.failed(path, err)
+			return false
+		}
+		cb.itemSuccess(fmt.Sprintf("Sent: %s", path))
+		c.report.transferred(path, exists)
+		return true
+	})
+}
+
+func (c *Client) fetchManifest() (*ManifestResponse, error) {
+	manifestURL := c.cfg.ServerAddr + "/manifest"
+	if c.cfg.RemotePath != "" {
+		manifestURL += "?path=" + url.QueryEscape(c.cfg.RemotePath)
+	}
+	resp, err := c.httpClient.Get(manifestURL)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && c.cfg.RemotePath != "" {
+		return nil, fmt.Errorf("remote path not found: %s", c.cfg.RemotePath)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode)
 	}
 	var manifest ManifestResponse
 	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
 		return nil, err
 	}
-	return manifest.Files, nil
+	return &manifest, nil
 }
 
-func (c *Client) fetchFiles(paths []string, cb ClientCallbacks) (int, error) {
-	reqBody, _ := json.Marshal(FileRequest{Paths: paths})
-	resp, err := c.httpClient.Post(
-		c.cfg.ServerAddr+"/files",
-		"application/json",
-		bytes.NewReader(reqBody),
-	)
+// localManifest builds the manifest of the sync directory, narrowed by the
+// client's filter.
+func (c *Client) localManifest() (*ManifestResponse, error) {
+	manifest, err := BuildManifestMeta(c.cfg.SyncDir, c.ignorer, c.cache)
+	if err != nil {
+		return manifest, err
+	}
+	c.filter.apply(manifest)
+	return manifest, nil
+}
+
+// filterManifest drops the paths this client ignores or filters out from a
+// server manifest.
+func (c *Client) filterManifest(manifest *ManifestResponse) *ManifestResponse {
+	filtered := &ManifestResponse{
+		Files: make(map[string]string, len(manifest.Files)),
+		Meta:  make(map[string]FileMeta, len(manifest.Meta)),
+	}
+	for path, hash := range manifest.Files {
+		if !c.ignorer.IsIgnored(path) {
+			filtered.Files[path] = hash
+			filtered.Meta[path] = manifest.Meta[path]
+		}
+	}
+	for _, dir := range manifest.Dirs {
+		if !c.ignorer.IsIgnored(dir) && !c.ignorer.Match(dir, true) {
+			filtered.Dirs = append(filtered.Dirs, dir)
+		}
+	}
+	c.filter.apply(filtered)
+	return filtered
+}
+
+func (c *Client) pullSymlink(path, target string) error {
+	return createSymlink(c.cfg.SyncDir, path, target, c.trash)
+}
+
+// applyServerMeta sets mode and mtime on the given local paths from the
+// server manifest and creates the server's empty directories.
+func (c *Client) applyServerMeta(paths []string, serverManifest *ManifestResponse, cb ClientCallbacks) {
+	for _, path := range paths {
+		meta, ok := serverManifest.Meta[path]
+		if !ok {
+			continue
+		}
+		fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+		if err != nil {
+			continue
+		}
+		if err := applyMeta(fullPath, meta); err != nil && !os.IsNotExist(err) {
+			cb.warn(fmt.Sprintf("Failed to set metadata on %s", path), err)
+		}
+	}
+	for _, dir := range serverManifest.Dirs {
+		fullPath, err := resolveSyncPath(c.cfg.SyncDir, dir)
+		if err != nil {
+			continue
+		}
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			cb.warn(fmt.Sprintf("Failed to create directory %s", dir), err)
+		}
+	}
+}
+
+func (c *Client) fileURL(path string) string {
+	return c.cfg.ServerAddr + "/file?path=" + url.QueryEscape(c.remotePath(path))
+}
+
+// fetchFile streams one file from the server into a partial file, resuming
+// from whatever an earlier interrupted run already received, and moves it
+// into place once its hash matches wantHash.
+func (c *Client) fetchFile(path, wantHash string) error {
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	offset := partialOffset(fullPath)
+	var stats transferStats
+	reported, err := c.fetchToPartial(path, fullPath, offset, &stats)
+	if err == nil {
+		err = commitPartial(fullPath, wantHash, c.trash)
+	}
+	if errors.Is(err, errHashMismatch) && offset > 0 {
+		// The partial data may predate a change on the server; start over
+		// once, taking back what the discarded attempt counted.
+		c.progress.Add(-reported)
+		stats.raw.Store(0)
+		stats.wire.Store(0)
+		if _, err = c.fetchToPartial(path, fullPath, 0, &stats); err == nil {
+			err = commitPartial(fullPath, wantHash, c.trash)
+		}
+	}
+	c.stats.raw.Add(stats.raw.Load())
+	c.stats.wire.Add(stats.wire.Load())
+	return err
+}
+
+// fetchToPartial counts the transfer into stats and returns the progress it
+// reported.
+func (c *Client) fetchToPartial(path, fullPath string, offset int64, stats *transferStats) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.fileURL(path), nil)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	// Setting Accept-Encoding ourselves also stops the transport from
+	// decompressing transparently, so the wire size can be measured.
+	if c.compresses(path) {
+		req.Header.Set("Accept-Encoding", encodingGzip)
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return 0, err
 	}
 	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		c.progress.Add(offset)
+	case http.StatusOK:
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Everything was already received; commitPartial decides if it is valid.
+		return 0, nil
+	default:
+		return 0, statusError(resp.StatusCode)
+	}
+	var body io.Reader = c.limiter.reader(countingReader{r: resp.Body, n: &stats.wire})
+	if resp.Header.Get("Content-Encoding") == encodingGzip {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return offset, fmt.Errorf("failed to read file %s: %w", path, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	f, err := openPartial(fullPath, offset)
+	if err != nil {
+		return offset, fmt.Errorf("failed to write file %s: %w", path, err)
+	}
+	n, err := io.Copy(countingWriter{w: f, n: &c.progress}, body)
+	stats.raw.Add(n)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return offset + n, fmt.Errorf("failed to write file %s: %w", path, err)
+	}
+	return offset + n, nil
+}
+
+// uploadFile streams one local file to the server as a raw PUT body,
+// continuing from the offset the server reports for an interrupted upload.
+func (c *Client) uploadFile(path, hash string) error {
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset, err := c.remoteOffset(path)
+	if err != nil {
+		return err
+	}
+	if offset >= info.Size() {
+		offset = 0
+	}
+	status, err := c.putFile(f, path, hash, offset, info.Size())
+	if err == nil && offset > 0 && (status == http.StatusConflict || status == http.StatusUnprocessableEntity) {
+		// The server's partial data is stale or out of step; resend in full.
+		status, err = c.putFile(f, path, hash, 0, info.Size())
+	}
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return statusError(status)
+	}
+	return nil
+}
+
+func (c *Client) remoteOffset(path string) (int64, error) {
+	resp, err := c.httpClient.Head(c.fileURL(path))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("server returned %d", resp.StatusCode)
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get(offsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, nil
 	}
+	return offset, nil
+}
 
-	var filesResp FilesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&filesResp); err != nil {
+func (c *Client) putFile(f *os.File, path, hash string, offset, size int64) (int, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
 		return 0, err
 	}
-	count := 0
-	for _, file := range filesResp.Files {
-		fullPath := filepath.Join(c.cfg.SyncDir, file.Path)
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-			return count, fmt.Errorf("failed to create directory for %s: %w", file.Path, err)
+	// A failed attempt takes back the progress it reported, and counts
+	// toward the totals only once it succeeds, so a retry does not count
+	// the same bytes twice.
+	var read, wire atomic.Int64
+	var status int
+	c.progress.Add(offset)
+	defer func() {
+		if status != http.StatusOK {
+			c.progress.Add(-offset - read.Load())
 		}
-		if err := os.WriteFile(fullPath, file.Content, 0644); err != nil {
-			return count, fmt.Errorf("failed to write file %s: %w", file.Path, err)
+	}()
+	// The wrapped reader keeps the http client from closing f, which a retry
+	// still needs; NoBody avoids a chunked request for empty files.
+	src := countingReader{r: countingReader{r: f, n: &read}, n: &c.progress}
+	var body io.Reader = c.limiter.reader(src)
+	length := size - offset
+	gzipped := size > offset && c.compresses(path)
+	if size == offset {
+		body = http.NoBody
+	} else if gzipped {
+		pr, pw := io.Pipe()
+		writeDone := make(chan struct{})
+		go func() {
+			gz := gzip.NewWriter(c.limiter.writer(countingWriter{w: pw, n: &wire}))
+			_, err := io.Copy(gz, src)
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+			pw.CloseWithError(err)
+			close(writeDone)
+		}()
+		defer func() {
+			pr.Close()
+			<-writeDone
+		}()
+		body = pr
+		length = -1
+	}
+	req, err := http.NewRequest(http.MethodPut, c.fileURL(path), body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if gzipped {
+		req.Header.Set("Content-Encoding", encodingGzip)
+	}
+	req.Header.Set(hashHeader, hash)
+	if offset > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+	if status == http.StatusOK {
+		c.stats.raw.Add(size - offset)
+		if gzipped {
+			c.stats.wire.Add(wire.Load())
+		} else {
+			c.stats.wire.Add(size - offset)
 		}
-		cb.itemSuccess(fmt.Sprintf("Synced: %s", file.Path))
-		count++
 	}
-	return count, nil
+	return status, nil
+}
+
+// compresses reports whether path should travel gzip-compressed.
+func (c *Client) compresses(path string) bool {
+	return c.gzip && compressible(path)
+}
+
+// deltaEligible reports whether path should be tried as a delta transfer; any
+// delta failure falls back to a full transfer.
+func (c *Client) deltaEligible(path string) bool {
+	if !c.cfg.Delta {
+		return false
+	}
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(fullPath)
+	return err == nil && info.Size() >= deltaMinSize
+}
+
+func (c *Client) deltaURL(path string) string {
+	return c.cfg.ServerAddr + "/delta?path=" + url.QueryEscape(c.remotePath(path))
+}
+
+// fetchDelta posts the signature of the local copy and rebuilds the file from
+// the server's delta.
+func (c *Client) fetchDelta(path, wantHash string) error {
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return err
+	}
+	sig, err := computeSignature(fullPath)
+	if err != nil {
+		return err
+	}
+	reqBody, _ := json.Marshal(sig)
+	resp, err := c.httpClient.Post(c.deltaURL(path), "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	body := c.limiter.reader(countingReader{r: resp.Body, n: &c.stats.wire})
+	if err := applyDeltaToPartial(fullPath, body, wantHash, c.trash); err != nil {
+		return err
+	}
+	if info, err := os.Stat(fullPath); err == nil {
+		c.stats.raw.Add(info.Size())
+	}
+	return nil
+}
+
+// uploadDelta fetches the server's signature for path and streams a delta of
+// the local file against it.
+func (c *Client) uploadDelta(path, hash string) error {
+	fullPath, err := resolveSyncPath(c.cfg.SyncDir, path)
+	if err != nil {
+		return err
+	}
+	sigResp, err := c.httpClient.Get(c.cfg.ServerAddr + "/signature?path=" + url.QueryEscape(c.remotePath(path)))
+	if err != nil {
+		return err
+	}
+	defer sigResp.Body.Close()
+	if sigResp.StatusCode != http.StatusOK {
+		return statusError(sigResp.StatusCode)
+	}
+	var sig Signature
+	if err := json.NewDecoder(sigResp.Body).Decode(&sig); err != nil {
+		return err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	writeDone := make(chan struct{})
+	go func() {
+		pw.CloseWithError(writeDelta(c.limiter.writer(countingWriter{w: pw, n: &c.stats.wire}), f, &sig))
+		close(writeDone)
+	}()
+	defer func() {
+		pr.Close()
+		<-writeDone
+	}()
+	req, err := http.NewRequest(http.MethodPut, c.deltaURL(path), pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(hashHeader, hash)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	if info, err := f.Stat(); err == nil {
+		c.stats.raw.Add(info.Size())
+	}
+	return nil
+}
+
+func (c *Client) sendDone(doneReq DoneRequest) error {
+	reqBody, _ := json.Marshal(c.remoteDone(doneReq))
+	resp, err := c.httpClient.Post(
+		c.cfg.ServerAddr+"/done",
+		"application/json",
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	return nil
 }
 
 func (c *Client) compareManifests(server, local map[string]string) (toRequest, toDelete []string) {
@@ -358,17 +941,19 @@ func (c *Client) compareManifests(server, local map[string]string) (toRequest, t
 	return
 }
 
-func (c *Client) deleteLocalFiles(paths []string, cb ClientCallbacks) (int, error) {
-	count := 0
+// deleteLocalFiles moves paths into the trash and returns those it removed.
+func (c *Client) deleteLocalFiles(paths []string, cb ClientCallbacks) ([]string, error) {
+	var deleted []string
 	for _, path := range paths {
 		fullPath := filepath.Join(c.cfg.SyncDir, path)
-		if err := os.RemoveAll(fullPath); err != nil {
+		if err := c.trash.remove(fullPath); err != nil {
 			cb.err(fmt.Sprintf("Failed to delete %s", path), err)
+			c.report.failed(path, err)
 		} else {
 			cb.itemSuccess(fmt.Sprintf("Deleted: %s", path))
-			count++
+			c.report.deleted(path)
+			deleted = append(deleted, path)
 		}
 	}
-	return count, nil
+	return deleted, nil
 }
-
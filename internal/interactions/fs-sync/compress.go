@@ -0,0 +1,95 @@
+package fssync
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const encodingGzip = "gzip"
+
+// incompressibleExts are formats that are already compressed, where gzip
+// would only cost CPU time.
+var incompressibleExts = map[string]bool{
+	".7z": true, ".aac": true, ".apk": true, ".avif": true, ".avi": true,
+	".br": true, ".bz2": true, ".docx": true, ".flac": true, ".gif": true,
+	".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true,
+	".m4a": true, ".m4v": true, ".mkv": true, ".mov": true, ".mp3": true,
+	".mp4": true, ".ogg": true, ".opus": true, ".pdf": true, ".png": true,
+	".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true,
+	".woff": true, ".woff2": true, ".xlsx": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+func compressible(path string) bool {
+	return !incompressibleExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// acceptsGzip reports whether an Accept-Encoding header lists gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, _, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(coding) == encodingGzip {
+			return true
+		}
+	}
+	return false
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// transferStats compares file bytes with the bytes that crossed the wire, to
+// report what compression and deltas saved.
+type transferStats struct {
+	raw  atomic.Int64
+	wire atomic.Int64
+}
+
+func (ts *transferStats) reset() {
+	ts.raw.Store(0)
+	ts.wire.Store(0)
+}
+
+// summary describes the saving on the wire, or is empty if nothing was saved.
+func (ts *transferStats) summary() string {
+	raw, wire := ts.raw.Load(), ts.wire.Load()
+	if raw == 0 || wire >= raw {
+		return ""
+	}
+	return fmt.Sprintf(", %s sent as %s (%.1fx compression)", formatBytes(raw), formatBytes(wire), float64(raw)/float64(max(wire, 1)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
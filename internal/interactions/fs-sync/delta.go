@@ -0,0 +1,324 @@
+package fssync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// deltaMinSize is the smallest basis file worth a delta transfer; below
+	// it the signature round-trip costs more than resending the file.
+	deltaMinSize = 1 << 20
+
+	minDeltaBlockSize = 2 << 10
+	maxDeltaBlockSize = 128 << 10
+
+	strongSumLen = 16
+
+	opCopy    byte = 'C'
+	opLiteral byte = 'L'
+	opEnd     byte = 'E'
+)
+
+// Signature describes the receiver's copy of a file as per-block weak
+// (rolling) and strong checksums, so the sender can find blocks it already has.
+type Signature struct {
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// deltaBlockSize follows rsync in scaling the block size with the square root
+// of the file size, bounded so tiny and huge files both stay reasonable.
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	return min(max(bs, minDeltaBlockSize), maxDeltaBlockSize)
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:strongSumLen]
+}
+
+// rollingSum is the rsync weak checksum: a is the plain byte sum and b the
+// position-weighted sum, both mod 2^16, so the window can slide in O(1).
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	var r rollingSum
+	r.n = uint32(len(block))
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	r.a &= 0xffff
+	r.b &= 0xffff
+	return r
+}
+
+func (r *rollingSum) roll(out, in byte) {
+	r.a = (r.a - uint32(out) + uint32(in)) & 0xffff
+	r.b = (r.b - r.n*uint32(out) + r.a) & 0xffff
+}
+
+func (r rollingSum) value() uint32 {
+	return r.a | r.b<<16
+}
+
+func computeSignature(path string) (*Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sig := &Signature{BlockSize: deltaBlockSize(info.Size())}
+	buf := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			block := buf[:n]
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Weak:   newRollingSum(block).value(),
+				Strong: strongSum(block),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type deltaWriter struct {
+	w       *bufio.Writer
+	literal []byte
+	limit   int
+	scratch [5]byte
+}
+
+func (dw *deltaWriter) addLiteral(c byte) error {
+	dw.literal = append(dw.literal, c)
+	if len(dw.literal) >= dw.limit {
+		return dw.flushLiteral()
+	}
+	return nil
+}
+
+func (dw *deltaWriter) flushLiteral() error {
+	if len(dw.literal) == 0 {
+		return nil
+	}
+	dw.scratch[0] = opLiteral
+	binary.BigEndian.PutUint32(dw.scratch[1:], uint32(len(dw.literal)))
+	if _, err := dw.w.Write(dw.scratch[:]); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(dw.literal); err != nil {
+		return err
+	}
+	dw.literal = dw.literal[:0]
+	return nil
+}
+
+func (dw *deltaWriter) copyBlock(idx int) error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	dw.scratch[0] = opCopy
+	binary.BigEndian.PutUint32(dw.scratch[1:], uint32(idx))
+	_, err := dw.w.Write(dw.scratch[:])
+	return err
+}
+
+func (dw *deltaWriter) finish() error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	if err := dw.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return dw.w.Flush()
+}
+
+// writeDelta streams the operations that rebuild src from the file described
+// by sig: a block-size header, then block copies where a full block matches
+// and literal bytes elsewhere. Memory use is bounded by a few blocks
+// regardless of file size.
+func writeDelta(w io.Writer, src io.Reader, sig *Signature) error {
+	bs := sig.BlockSize
+	if bs <= 0 {
+		return errors.New("invalid signature block size")
+	}
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+	dw := &deltaWriter{w: bufio.NewWriter(w), limit: bs}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(bs))
+	if _, err := dw.w.Write(header[:]); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(src, 2*bs)
+
+	// buf[start:end] is the current window; it is compacted once start
+	// passes bs so the buffer never grows beyond 2*bs.
+	buf := make([]byte, 2*bs)
+	start, end := 0, 0
+	fill := func() error {
+		n, err := io.ReadFull(br, buf[end:start+bs])
+		end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	if err := fill(); err != nil {
+		return err
+	}
+	sum := newRollingSum(buf[start:end])
+	for end-start == bs {
+		window := buf[start:end]
+		if idx, ok := matchBlock(index, sig, sum.value(), window); ok {
+			if err := dw.copyBlock(idx); err != nil {
+				return err
+			}
+			start, end = 0, 0
+			if err := fill(); err != nil {
+				return err
+			}
+			sum = newRollingSum(buf[start:end])
+			continue
+		}
+		next, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out := buf[start]
+		if err := dw.addLiteral(out); err != nil {
+			return err
+		}
+		if start >= bs {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+		}
+		start++
+		buf[end] = next
+		end++
+		sum.roll(out, next)
+	}
+	for _, c := range buf[start:end] {
+		if err := dw.addLiteral(c); err != nil {
+			return err
+		}
+	}
+	return dw.finish()
+}
+
+func matchBlock(index map[uint32][]int, sig *Signature, weak uint32, window []byte) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(window)
+	for _, idx := range candidates {
+		if bytes.Equal(sig.Blocks[idx].Strong, strong) {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// applyDelta rebuilds the sender's file into out using basis for block copies.
+func applyDelta(out io.Writer, basis io.ReaderAt, delta io.Reader) error {
+	br := bufio.NewReader(delta)
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return fmt.Errorf("truncated delta: %w", err)
+	}
+	blockSize := int(binary.BigEndian.Uint32(header[:]))
+	if blockSize <= 0 || blockSize > maxDeltaBlockSize {
+		return fmt.Errorf("invalid delta block size %d", blockSize)
+	}
+	block := make([]byte, blockSize)
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("truncated delta: %w", err)
+		}
+		if op == opEnd {
+			return nil
+		}
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return fmt.Errorf("truncated delta: %w", err)
+		}
+		arg := binary.BigEndian.Uint32(header[:])
+		switch op {
+		case opCopy:
+			n, err := basis.ReadAt(block, int64(arg)*int64(blockSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("delta references missing block %d", arg)
+			}
+			if _, err := out.Write(block[:n]); err != nil {
+				return err
+			}
+		case opLiteral:
+			if _, err := io.CopyN(out, br, int64(arg)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown delta op %q", op)
+		}
+	}
+}
+
+// applyDeltaToPartial rebuilds fullPath from its current contents and delta
+// into the partial file, then commits it if the result hashes to wantHash.
+func applyDeltaToPartial(fullPath string, delta io.Reader, wantHash string, trash *Trash) error {
+	basis, err := openRegular(fullPath)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	f, err := openPartial(fullPath, 0)
+	if err != nil {
+		return err
+	}
+	err = applyDelta(f, basis, delta)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath(fullPath))
+		return err
+	}
+	return commitPartial(fullPath, wantHash, trash)
+}
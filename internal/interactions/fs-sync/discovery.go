@@ -0,0 +1,171 @@
+package fssync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	// discoveryService is the DNS-SD service type fs-sync servers register.
+	discoveryService = "_nits-sync._tcp"
+
+	discoveryTimeout = 2 * time.Second
+)
+
+// mdnsLogger silences the library's own logging; failures surface as errors.
+var mdnsLogger = log.New(io.Discard, "", 0)
+
+// DiscoveredServer is an fs-sync server found on the LAN, described by the
+// TXT record it advertises.
+type DiscoveredServer struct {
+	Name        string
+	URL         string
+	Mode        string
+	Auth        bool
+	Fingerprint string
+}
+
+func (d DiscoveredServer) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %s  (mode: %s", d.Name, d.URL, d.Mode)
+	if d.Auth {
+		b.WriteString(", pairing code")
+	}
+	if d.Fingerprint != "" {
+		b.WriteString(", tls")
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// advertise registers the server over mDNS until the returned server is shut
+// down. A nil iface uses the system's default multicast interface.
+func (s *Server) advertise(iface *net.Interface, ips []net.IP) (*mdns.Server, error) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "nits"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	if len(ips) == 0 {
+		ips = advertiseIPs()
+	}
+	txt := []string{"mode=" + s.cfg.Mode}
+	if s.verifier != nil {
+		txt = append(txt, "auth=1")
+	}
+	if fp := s.Fingerprint(); fp != "" {
+		txt = append(txt, "fp="+fp)
+	}
+	instance := fmt.Sprintf("%s-%d", host, s.cfg.Port)
+	service, err := mdns.NewMDNSService(instance, discoveryService, "", host+".", s.cfg.Port, ips, txt)
+	if err != nil {
+		return nil, err
+	}
+	return mdns.NewServer(&mdns.Config{Zone: service, Iface: iface, Logger: mdnsLogger})
+}
+
+// advertiseIPs lists the host's unicast addresses, falling back to loopback
+// so a server on an isolated machine can still be found locally.
+func advertiseIPs() []net.IP {
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		ips = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	return ips
+}
+
+// Discover browses the LAN for fs-sync servers for a couple of seconds.
+func Discover(ctx context.Context) ([]DiscoveredServer, error) {
+	return discover(ctx, nil, discoveryTimeout)
+}
+
+func discover(ctx context.Context, iface *net.Interface, timeout time.Duration) ([]DiscoveredServer, error) {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	found := make(map[string]DiscoveredServer)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for entry := range entries {
+			if server, ok := parseServiceEntry(entry); ok {
+				found[server.URL] = server
+			}
+		}
+	}()
+	query := func(disableIPv6 bool) error {
+		return mdns.QueryContext(ctx, &mdns.QueryParam{
+			Service:     discoveryService,
+			Timeout:     timeout,
+			Interface:   iface,
+			Entries:     entries,
+			DisableIPv6: disableIPv6,
+			Logger:      mdnsLogger,
+		})
+	}
+	// Sending fails outright on hosts without an IPv6 route, so fall back to
+	// IPv4 alone rather than giving up.
+	err := query(false)
+	if err != nil && ctx.Err() == nil {
+		err = query(true)
+	}
+	close(entries)
+	<-collected
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	servers := make([]DiscoveredServer, 0, len(found))
+	for _, server := range found {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers, nil
+}
+
+func parseServiceEntry(entry *mdns.ServiceEntry) (DiscoveredServer, bool) {
+	if !strings.Contains(entry.Name, discoveryService) || entry.Port == 0 {
+		return DiscoveredServer{}, false
+	}
+	server := DiscoveredServer{Name: strings.SplitN(entry.Name, ".", 2)[0]}
+	for _, field := range entry.InfoFields {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "mode":
+			server.Mode = value
+		case "auth":
+			server.Auth = value == "1"
+		case "fp":
+			server.Fingerprint = value
+		}
+	}
+	var host string
+	switch {
+	case entry.AddrV4 != nil:
+		host = entry.AddrV4.String()
+	case entry.AddrV6 != nil:
+		host = entry.AddrV6.String()
+	default:
+		return DiscoveredServer{}, false
+	}
+	scheme := "http"
+	if server.Fingerprint != "" {
+		scheme = "https"
+	}
+	server.URL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, fmt.Sprint(entry.Port)))
+	return server, true
+}
@@ -0,0 +1,154 @@
+package fssync
+
+import (
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter narrows a sync to the files matching every selector that is set;
+// the zero Filter keeps everything. Paths outside it are left alone on both
+// sides, including by --delete.
+type Filter struct {
+	// Include holds comma-separated gitignore-style patterns, at least one
+	// of which a file must match.
+	Include   string
+	MinSize   int64
+	MaxSize   int64
+	NewerThan time.Duration
+	OlderThan time.Duration
+}
+
+type manifestFilter struct {
+	Filter
+	include *PathIgnorer
+}
+
+// newManifestFilter returns nil for the zero Filter, which keeps everything.
+func newManifestFilter(f Filter) *manifestFilter {
+	if f == (Filter{}) {
+		return nil
+	}
+	mf := &manifestFilter{Filter: f}
+	if strings.TrimSpace(f.Include) != "" {
+		mf.include = NewPathIgnorer(f.Include)
+	}
+	return mf
+}
+
+func (mf *manifestFilter) keep(path string, meta FileMeta, now time.Time) bool {
+	if mf.include != nil && !mf.include.IsIgnored(path) {
+		return false
+	}
+	if mf.MinSize > 0 && meta.Size < mf.MinSize {
+		return false
+	}
+	if mf.MaxSize > 0 && meta.Size > mf.MaxSize {
+		return false
+	}
+	age := now.Sub(time.Unix(0, meta.ModTime))
+	if mf.NewerThan > 0 && age > mf.NewerThan {
+		return false
+	}
+	if mf.OlderThan > 0 && age < mf.OlderThan {
+		return false
+	}
+	return true
+}
+
+// keepFile applies the filter to a file on disk, for requests that name a
+// path directly rather than through the manifest. A nil filter keeps all.
+func (mf *manifestFilter) keepFile(path string, info fs.FileInfo) bool {
+	if mf == nil {
+		return true
+	}
+	return mf.keep(path, FileMeta{Size: info.Size(), ModTime: info.ModTime().UnixNano()}, time.Now())
+}
+
+// apply moves the files the filter rejects from manifest's Files to
+// Filtered. Empty directories hold no matching files, so a filtered manifest
+// leaves them out too.
+func (mf *manifestFilter) apply(manifest *ManifestResponse) {
+	if mf == nil {
+		return
+	}
+	now := time.Now()
+	for path := range manifest.Files {
+		if !mf.keep(path, manifest.Meta[path], now) {
+			delete(manifest.Files, path)
+			delete(manifest.Meta, path)
+			manifest.Filtered = append(manifest.Filtered, path)
+		}
+	}
+	slices.Sort(manifest.Filtered)
+	manifest.Dirs = nil
+}
+
+// filteredBy reports whether the side that built manifest holds path but its
+// filter left it out. Filtered is sorted.
+func filteredBy(manifest *ManifestResponse, path string) bool {
+	_, ok := slices.BinarySearch(manifest.Filtered, path)
+	return ok
+}
+
+// notHeldBy drops the paths manifest still holds from a delete list. Size and
+// age are judged on each side's own copy, so a path missing from the other
+// side's Files may only have been filtered out there.
+func notHeldBy(paths []string, manifest *ManifestResponse) []string {
+	var kept []string
+	for _, path := range paths {
+		if _, ok := manifest.Files[path]; !ok && !filteredBy(manifest, path) {
+			kept = append(kept, path)
+		}
+	}
+	return kept
+}
+
+// ParseSize parses a size such as "100MB", "512K" or "1.5G" (binary
+// multiples, with or without a trailing B). A bare number is bytes.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(size)), "B")
+	multiplier := 1.0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * multiplier), nil
+}
+
+// ParseAge parses an age for --newer-than and --older-than: anything
+// time.ParseDuration accepts, plus days ("7d") and weeks ("2w").
+func ParseAge(age string) (time.Duration, error) {
+	s := strings.TrimSpace(strings.ToLower(age))
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if unit, ok := units[s[max(len(s)-1, 0):]]; ok {
+		value, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || value <= 0 {
+			return 0, fmt.Errorf("invalid age %q", age)
+		}
+		return time.Duration(value * float64(unit)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q", age)
+	}
+	return d, nil
+}
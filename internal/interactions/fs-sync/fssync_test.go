@@ -1,9 +1,31 @@
 package fssync
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 func TestPathIgnorerIsIgnored(t *testing.T) {
@@ -19,6 +41,18 @@ func TestPathIgnorerIsIgnored(t *testing.T) {
 		{"no match", "*.log", "dir/app.txt", false},
 		{"whitespace trimmed patterns", " .git , node_modules ", ".git/config", true},
 		{"all-empty pattern string ignored", " , ,", "anything", false},
+		{"name does not match inside another name", "bin", "cabinet/notes.txt", false},
+		{"unanchored name matches at any depth", "bin", "src/bin/tool", true},
+		{"anchored pattern matches at root", "/build", "build/out.o", true},
+		{"anchored pattern skips nested", "/build", "src/build/out.o", false},
+		{"directory-only pattern skips files", "logs/", "logs", false},
+		{"directory-only pattern matches contents", "logs/", "logs/a.txt", true},
+		{"leading double star", "**/tmp/*.txt", "a/b/tmp/x.txt", true},
+		{"trailing double star", "docs/**", "docs/a/b.md", true},
+		{"middle double star matches zero dirs", "a/**/z", "a/z", true},
+		{"negation re-includes file", "*.log,!keep.log", "keep.log", false},
+		{"negation keeps other matches", "*.log,!keep.log", "a.log", true},
+		{"negation cannot escape ignored dir", "build/,!build/keep.txt", "build/keep.txt", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -45,7 +79,7 @@ func TestBuildManifest(t *testing.T) {
 		t.Fatalf("failed to write fixture: %v", err)
 	}
 
-	manifest, err := BuildManifest(dir, NewPathIgnorer("*.log"))
+	manifest, err := BuildManifest(dir, NewPathIgnorer("*.log"), nil)
 	if err != nil {
 		t.Fatalf("BuildManifest() error = %v", err)
 	}
@@ -65,7 +99,7 @@ func TestBuildManifest(t *testing.T) {
 		t.Error("distinct file contents produced the same hash")
 	}
 
-	manifest2, err := BuildManifest(dir, NewPathIgnorer("*.log"))
+	manifest2, err := BuildManifest(dir, NewPathIgnorer("*.log"), nil)
 	if err != nil {
 		t.Fatalf("BuildManifest() second run error = %v", err)
 	}
@@ -74,6 +108,85 @@ func TestBuildManifest(t *testing.T) {
 	}
 }
 
+func TestLoadPathIgnorer(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, ".gitignore", "# build output\nbuild/\n*.tmp\n")
+	writeFixture(t, dir, ".nitsignore", "!keep.tmp\n/secret.txt\n")
+	writeFixture(t, dir, "build/out.o", "o")
+	writeFixture(t, dir, "a.tmp", "a")
+	writeFixture(t, dir, "keep.tmp", "k")
+	writeFixture(t, dir, "secret.txt", "s")
+	writeFixture(t, dir, "sub/secret.txt", "s")
+	writeFixture(t, dir, "cabinet/notes.txt", "n")
+
+	for _, tt := range []struct {
+		gitignore bool
+		want      []string
+	}{
+		{true, []string{".gitignore", ".nitsignore", "keep.tmp", "sub/secret.txt"}},
+		// .gitignore is opt-in, so by default only .nitsignore and --ignore apply.
+		{false, []string{".gitignore", ".nitsignore", "build/out.o", "a.tmp", "keep.tmp", "sub/secret.txt"}},
+	} {
+		pi, err := LoadPathIgnorer(dir, "cabinet", tt.gitignore)
+		if err != nil {
+			t.Fatalf("LoadPathIgnorer() error = %v", err)
+		}
+		manifest, err := BuildManifest(dir, pi, nil)
+		if err != nil {
+			t.Fatalf("BuildManifest() error = %v", err)
+		}
+		var got []string
+		for path := range manifest {
+			got = append(got, path)
+		}
+		if !equalSets(got, tt.want) {
+			t.Errorf("gitignore=%v: manifest paths = %v, want %v", tt.gitignore, got, tt.want)
+		}
+	}
+}
+
+func TestBuildManifestCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFixture(t, dir, "photo.jpg", "original")
+	cache, err := LoadManifestCache(dir, false)
+	if err != nil {
+		t.Fatalf("LoadManifestCache() error = %v", err)
+	}
+	first, err := BuildManifest(dir, nil, cache)
+	if err != nil {
+		t.Fatalf("BuildManifest() error = %v", err)
+	}
+
+	// Same size and mtime: a fresh cache from disk must reuse the stored hash
+	// without reading the (silently changed) content.
+	fullPath := filepath.Join(dir, "photo.jpg")
+	info, _ := os.Stat(fullPath)
+	writeFixture(t, dir, "photo.jpg", "modified")
+	os.Chtimes(fullPath, info.ModTime(), info.ModTime())
+
+	cache, _ = LoadManifestCache(dir, false)
+	cached, _ := BuildManifest(dir, nil, cache)
+	if cached["photo.jpg"] != first["photo.jpg"] {
+		t.Error("expected cached hash to be reused for unchanged size and mtime")
+	}
+
+	cache, _ = LoadManifestCache(dir, true)
+	rehashed, _ := BuildManifest(dir, nil, cache)
+	if rehashed["photo.jpg"] == first["photo.jpg"] {
+		t.Error("expected rehash to read the file again")
+	}
+
+	newTime := info.ModTime().Add(time.Minute)
+	writeFixture(t, dir, "photo.jpg", "original")
+	os.Chtimes(fullPath, newTime, newTime)
+	cache, _ = LoadManifestCache(dir, false)
+	touched, _ := BuildManifest(dir, nil, cache)
+	if touched["photo.jpg"] != first["photo.jpg"] {
+		t.Error("expected changed mtime to trigger a rehash")
+	}
+}
+
 func TestCompareManifests(t *testing.T) {
 	c := &Client{}
 	tests := []struct {
@@ -147,3 +260,1750 @@ func equalSets(a, b []string) bool {
 	}
 	return true
 }
+
+func TestResolveSyncPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"a.txt", false},
+		{"sub/b.txt", false},
+		{"../escape.txt", true},
+		{"sub/../../escape.txt", true},
+		{"/etc/passwd", true},
+		{".", true},
+		{"linked", false},
+		{"linked/x.txt", true},
+		{"missing/x.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := resolveSyncPath(root, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveSyncPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if err == nil && !strings.HasPrefix(got, root) {
+				t.Errorf("resolveSyncPath(%q) = %q, escapes root %q", tt.path, got, root)
+			}
+		})
+	}
+}
+
+func TestCheckLinkTarget(t *testing.T) {
+	tests := []struct {
+		path, target string
+		wantErr      bool
+	}{
+		{"link", "a.txt", false},
+		{"sub/link", "../a.txt", false},
+		{"sub/link", "../../a.txt", true},
+		{"link", "../escape", true},
+		{"link", "sub/../../escape", true},
+		{"link", "/etc/passwd", true},
+	}
+	for _, tt := range tests {
+		if err := checkLinkTarget(tt.path, tt.target); (err != nil) != tt.wantErr {
+			t.Errorf("checkLinkTarget(%q, %q) error = %v, wantErr %v", tt.path, tt.target, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServerDoesNotFollowSymlinks(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	writeFixture(t, outside, "secret.txt", "outside the root")
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, ServerConfig{SyncDir: dir, Mode: "send"})
+
+	resp, err := http.Get(ts.URL + "/file?path=escape")
+	if err != nil {
+		t.Fatalf("GET /file error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || strings.Contains(string(body), "outside the root") {
+		t.Errorf("GET /file on a symlink: status = %d, body %q; want it refused", resp.StatusCode, body)
+	}
+
+	resp, err = http.Post(ts.URL+"/delta?path=escape", "application/json", strings.NewReader(`{"block_size":1024}`))
+	if err != nil {
+		t.Fatalf("POST /delta error = %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || strings.Contains(string(body), "outside the root") {
+		t.Errorf("POST /delta on a symlink: status = %d, body %q; want it refused", resp.StatusCode, body)
+	}
+}
+
+func TestClientServerRefusesEscapingSymlinks(t *testing.T) {
+	for _, mode := range []string{"send", "receive"} {
+		t.Run(mode, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			writeFixture(t, srcDir, "a.txt", "alpha")
+			for name, target := range map[string]string{"inside": "a.txt", "up": "../outside", "abs": "/etc/passwd"} {
+				if err := os.Symlink(target, filepath.Join(srcDir, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: mode})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got, err := os.Readlink(filepath.Join(dstDir, "inside")); err != nil || got != "a.txt" {
+				t.Errorf("inside link = %q, %v; want a.txt", got, err)
+			}
+			for _, name := range []string{"up", "abs"} {
+				if _, err := os.Lstat(filepath.Join(dstDir, name)); !os.IsNotExist(err) {
+					t.Errorf("expected escaping link %s refused, lstat err = %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func writeFixture(t *testing.T, root, rel, content string) {
+	t.Helper()
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatalf("failed to mkdir: %v", err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+}
+
+func startTestServer(t *testing.T, cfg ServerConfig) *httptest.Server {
+	t.Helper()
+	// Keep manifest caches out of the real home directory.
+	t.Setenv("HOME", t.TempDir())
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestClientServerSync(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+	}{
+		{"pull from send server", "send"},
+		{"push to receive server", "receive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if tt.mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			writeFixture(t, srcDir, "a.txt", "alpha")
+			writeFixture(t, srcDir, "nested/b.bin", strings.Repeat("b", 1<<20))
+			writeFixture(t, dstDir, "a.txt", "stale")
+			writeFixture(t, dstDir, "extra.txt", "extra")
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: tt.mode, DeleteExtra: true})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, DeleteExtra: true})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			srcManifest, _ := BuildManifest(srcDir, nil, nil)
+			dstManifest, _ := BuildManifest(dstDir, nil, nil)
+			if len(srcManifest) != len(dstManifest) {
+				t.Fatalf("manifests differ: src=%v dst=%v", srcManifest, dstManifest)
+			}
+			for path, hash := range srcManifest {
+				if dstManifest[path] != hash {
+					t.Errorf("%s: dst hash %q, want %q", path, dstManifest[path], hash)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRangeHeaders(t *testing.T) {
+	if start, ok := parseRangeStart("bytes=1024-"); !ok || start != 1024 {
+		t.Errorf("parseRangeStart(bytes=1024-) = %d, %v", start, ok)
+	}
+	for _, h := range []string{"", "bytes=0-10", "items=5-", "bytes=-5", "bytes=abc-"} {
+		if _, ok := parseRangeStart(h); ok {
+			t.Errorf("parseRangeStart(%q) accepted an unsupported range", h)
+		}
+	}
+	if start, total, ok := parseContentRange("bytes 100-199/200"); !ok || start != 100 || total != 200 {
+		t.Errorf("parseContentRange = %d, %d, %v", start, total, ok)
+	}
+	for _, h := range []string{"", "bytes 100-199", "bytes x-1/2", "bytes 300-399/200"} {
+		if _, _, ok := parseContentRange(h); ok {
+			t.Errorf("parseContentRange(%q) accepted an invalid header", h)
+		}
+	}
+}
+
+func TestClientServerResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 50000)
+	tests := []struct {
+		name    string
+		mode    string
+		partial string
+	}{
+		{"pull resumes valid partial", "send", content[:123456]},
+		{"pull restarts corrupt partial", "send", "garbage"},
+		{"push resumes valid partial", "receive", content[:234567]},
+		{"push restarts corrupt partial", "receive", "garbage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if tt.mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			writeFixture(t, srcDir, "big.bin", content)
+			writeFixture(t, dstDir, "big.bin"+partialSuffix, tt.partial)
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: tt.mode})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dstDir, "big.bin"))
+			if err != nil {
+				t.Fatalf("expected big.bin on receiver: %v", err)
+			}
+			if string(got) != content {
+				t.Errorf("received %d bytes that do not match the %d-byte source", len(got), len(content))
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "big.bin"+partialSuffix)); !os.IsNotExist(err) {
+				t.Errorf("expected partial file to be gone after commit, stat err = %v", err)
+			}
+			if got := c.progress.Load(); got != int64(len(content)) {
+				t.Errorf("progress = %d bytes, want %d", got, len(content))
+			}
+			if c.report.Bytes > int64(len(content)) || c.report.WireBytes > int64(len(content)) {
+				t.Errorf("report counts %d file bytes as %d on the wire, want at most %d", c.report.Bytes, c.report.WireBytes, len(content))
+			}
+		})
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	basis := make([]byte, 3<<20)
+	for i := range basis {
+		basis[i] = byte((i * 7919) >> 5)
+	}
+	modified := func(f func([]byte) []byte) []byte {
+		return f(append([]byte(nil), basis...))
+	}
+	tests := []struct {
+		name      string
+		target    []byte
+		wantSmall bool
+	}{
+		{"identical", basis, true},
+		{"bytes changed mid-file", modified(func(b []byte) []byte {
+			copy(b[1<<20:], "changed block contents")
+			return b
+		}), true},
+		{"insertion shifts later blocks", modified(func(b []byte) []byte {
+			return append(b[:500000:500000], append([]byte("inserted"), b[500000:]...)...)
+		}), true},
+		{"appended tail", modified(func(b []byte) []byte {
+			return append(b, []byte("appended data")...)
+		}), true},
+		{"truncated", basis[:len(basis)/2], true},
+		{"unrelated content", []byte(strings.Repeat("unrelated", 1000)), false},
+	}
+	dir := t.TempDir()
+	basisPath := filepath.Join(dir, "basis.bin")
+	if err := os.WriteFile(basisPath, basis, 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	sig, err := computeSignature(basisPath)
+	if err != nil {
+		t.Fatalf("computeSignature() error = %v", err)
+	}
+	basisFile, err := os.Open(basisPath)
+	if err != nil {
+		t.Fatalf("failed to open basis: %v", err)
+	}
+	defer basisFile.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delta bytes.Buffer
+			if err := writeDelta(&delta, bytes.NewReader(tt.target), sig); err != nil {
+				t.Fatalf("writeDelta() error = %v", err)
+			}
+			if tt.wantSmall && delta.Len() > len(tt.target)/10 {
+				t.Errorf("delta is %d bytes for a %d-byte target, expected mostly block copies", delta.Len(), len(tt.target))
+			}
+			var out bytes.Buffer
+			if err := applyDelta(&out, basisFile, &delta); err != nil {
+				t.Fatalf("applyDelta() error = %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.target) {
+				t.Errorf("reconstructed %d bytes that do not match the %d-byte target", out.Len(), len(tt.target))
+			}
+		})
+	}
+}
+
+func TestClientServerDeltaSync(t *testing.T) {
+	base := strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789", 80000)
+	updated := base[:1500000] + "EDITED" + base[1500000:]
+	for _, mode := range []string{"send", "receive"} {
+		t.Run(mode, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			writeFixture(t, srcDir, "vm.img", updated)
+			writeFixture(t, dstDir, "vm.img", base)
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: mode})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, Delta: true})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			var items []string
+			if err := c.Run(ClientCallbacks{OnItemSuccess: func(msg string) { items = append(items, msg) }}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if len(items) != 1 || !strings.Contains(items[0], "(delta)") {
+				t.Errorf("expected a single delta transfer, got %v", items)
+			}
+			got, err := os.ReadFile(filepath.Join(dstDir, "vm.img"))
+			if err != nil {
+				t.Fatalf("failed to read result: %v", err)
+			}
+			if string(got) != updated {
+				t.Error("delta-synced file does not match the source")
+			}
+			if c.report.Bytes != int64(len(updated)) || c.report.WireBytes <= 0 || c.report.WireBytes >= c.report.Bytes/10 {
+				t.Errorf("report counts %d file bytes as %d on the wire, want %d as a small delta", c.report.Bytes, c.report.WireBytes, len(updated))
+			}
+		})
+	}
+}
+
+func TestSignatureRespectsIgnoreAndFilter(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "ok.txt", "fine")
+	writeFixture(t, dir, "secret.key", "hidden")
+	writeFixture(t, dir, "big.bin", strings.Repeat("x", 4096))
+	ts := startTestServer(t, ServerConfig{SyncDir: dir, Mode: "receive", IgnorePaths: "*.key", Filter: Filter{MaxSize: 1024}})
+
+	for path, want := range map[string]int{
+		"ok.txt":     http.StatusOK,
+		"secret.key": http.StatusForbidden,
+		"big.bin":    http.StatusForbidden,
+	} {
+		resp, err := http.Get(ts.URL + "/signature?path=" + url.QueryEscape(path))
+		if err != nil {
+			t.Fatalf("GET /signature error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("signature of %s: status = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestPushLeavesServerFilteredFilesAlone(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	big := strings.Repeat("s", 4096)
+	writeFixture(t, serverDir, "big.bin", big)
+	writeFixture(t, clientDir, "big.bin", "client copy")
+	writeFixture(t, clientDir, "ok.txt", "fine")
+	ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "receive", Filter: Filter{MaxSize: 1024}, Watch: true})
+
+	c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := c.Run(ClientCallbacks{}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(serverDir, "ok.txt")); string(got) != "fine" {
+		t.Errorf("ok.txt = %q, want it pushed", got)
+	}
+
+	// A client that ignores the manifest is refused too.
+	sum := sha256.Sum256([]byte("client copy"))
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/file?path=big.bin", strings.NewReader("client copy"))
+	req.Header.Set(hashHeader, hex.EncodeToString(sum[:]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT /file error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT of a filtered file: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if got, _ := os.ReadFile(filepath.Join(serverDir, "big.bin")); string(got) != big {
+		t.Error("expected the server's oversized big.bin left untouched")
+	}
+}
+
+func TestPairingCodeAuth(t *testing.T) {
+	code, err := GeneratePairingCode()
+	if err != nil {
+		t.Fatalf("GeneratePairingCode() error = %v", err)
+	}
+	if len(code) != 9 || code[4] != '-' {
+		t.Errorf("unexpected pairing code format %q", code)
+	}
+
+	tests := []struct {
+		name       string
+		clientCode string
+		wantErr    bool
+	}{
+		{"correct code", code, false},
+		{"code is case and separator insensitive", strings.ToLower(strings.ReplaceAll(code, "-", " ")), false},
+		{"wrong code", "AAAA-AAAA", true},
+		{"missing code", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			writeFixture(t, srcDir, "a.txt", "alpha")
+			ts := startTestServer(t, ServerConfig{SyncDir: srcDir, Mode: "send", PairingCode: code})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: dstDir, PairingCode: tt.clientCode})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			err = c.Run(ClientCallbacks{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, statErr := os.Stat(filepath.Join(dstDir, "a.txt"))
+			if tt.wantErr && statErr == nil {
+				t.Error("file was transferred despite failed authentication")
+			}
+		})
+	}
+
+	t.Run("unsigned and replayed requests rejected", func(t *testing.T) {
+		ts := startTestServer(t, ServerConfig{SyncDir: t.TempDir(), Mode: "receive", PairingCode: code})
+		resp, err := http.Get(ts.URL + "/manifest")
+		if err != nil {
+			t.Fatalf("GET /manifest error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("unsigned /manifest status = %d, want 401", resp.StatusCode)
+		}
+
+		// The bare code only redeems a session; it does not sign requests.
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/manifest", nil)
+		if err := signRequest(req, code, ""); err != nil {
+			t.Fatalf("signRequest() error = %v", err)
+		}
+		if resp, err := http.DefaultClient.Do(req); err != nil {
+			t.Fatalf("code-signed request error = %v", err)
+		} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("code-signed /manifest status = %d, want 401", resp.StatusCode)
+		}
+
+		sess := pairedSession(t, ts.URL, code)
+		req, _ = http.NewRequest(http.MethodGet, ts.URL+"/manifest", nil)
+		if err := signRequest(req, sess.key, sess.id); err != nil {
+			t.Fatalf("signRequest() error = %v", err)
+		}
+		for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request %d error = %v", i, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("request %d status = %d, want %d", i, resp.StatusCode, want)
+			}
+		}
+	})
+}
+
+func TestPairingCodeIsSingleUse(t *testing.T) {
+	for range 20 {
+		code, err := GeneratePairingCode()
+		if err != nil {
+			t.Fatalf("GeneratePairingCode() error = %v", err)
+		}
+		if strings.Trim(strings.ReplaceAll(code, "-", ""), pairingAlphabet) != "" {
+			t.Fatalf("pairing code %q uses characters outside the alphabet", code)
+		}
+	}
+
+	code := "ABCD-EFGH"
+	ts := startTestServer(t, ServerConfig{SyncDir: t.TempDir(), Mode: "send", PairingCode: code, MaxClients: 2})
+	first := pairedSession(t, ts.URL, code)
+	second := &authTransport{base: http.DefaultTransport, code: code}
+	if err := second.pair(&http.Client{Transport: second}, ts.URL); err == nil {
+		t.Fatal("expected a used pairing code to be rejected")
+	}
+
+	// The first client's session keeps working.
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/manifest", nil)
+	if err := signRequest(req, first.key, first.id); err != nil {
+		t.Fatalf("signRequest() error = %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /manifest error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("paired /manifest status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// pairedSession redeems code with the server at serverURL, for tests that sign
+// requests by hand.
+func pairedSession(t *testing.T, serverURL, code string) *authSession {
+	t.Helper()
+	at := &authTransport{base: http.DefaultTransport, code: code}
+	if err := at.pair(&http.Client{Transport: at}, serverURL); err != nil {
+		t.Fatalf("pair() error = %v", err)
+	}
+	return at.session.Load()
+}
+
+func TestPairingCodeCoversBody(t *testing.T) {
+	code, err := GeneratePairingCode()
+	if err != nil {
+		t.Fatalf("GeneratePairingCode() error = %v", err)
+	}
+	dir := t.TempDir()
+	ts := startTestServer(t, ServerConfig{SyncDir: dir, Mode: "receive", PairingCode: code})
+	sess := pairedSession(t, ts.URL, code)
+	send := func(method, path string, body []byte, hash string, tamper func(*http.Request)) int {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if hash != "" {
+			req.Header.Set(hashHeader, hash)
+		}
+		if err := signRequest(req, sess.key, sess.id); err != nil {
+			t.Fatalf("signRequest() error = %v", err)
+		}
+		tamper(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s error = %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	hashBytes := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	content := []byte("genuine")
+	hash := hashBytes(content)
+	swapped := []byte("swapped")
+	if got := send(http.MethodPut, "/file?path=a.txt", content, hash, func(req *http.Request) {
+		req.Header.Set(hashHeader, hashBytes(swapped))
+		req.Body = io.NopCloser(bytes.NewReader(swapped))
+		req.ContentLength = int64(len(swapped))
+	}); got != http.StatusUnauthorized {
+		t.Errorf("PUT with a swapped hash header: status = %d, want 401", got)
+	}
+	if got := send(http.MethodPost, "/done", []byte(`{"files":["a.txt"]}`), "", func(req *http.Request) {
+		tampered := []byte(`{"to_delete":["a.txt"]}`)
+		req.Body = io.NopCloser(bytes.NewReader(tampered))
+		req.ContentLength = int64(len(tampered))
+	}); got != http.StatusUnauthorized {
+		t.Errorf("POST /done with a swapped body: status = %d, want 401", got)
+	}
+	if got := send(http.MethodPut, "/file?path=a.txt", content, hash, func(*http.Request) {}); got != http.StatusOK {
+		t.Errorf("untampered PUT: status = %d, want 200", got)
+	}
+}
+
+func TestClientPinsServerFingerprint(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	srcDir := t.TempDir()
+	writeFixture(t, srcDir, "a.txt", "alpha")
+	s, err := NewServer(ServerConfig{SyncDir: srcDir, Mode: "send", EnableTLS: true})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ts := httptest.NewUnstartedServer(s.handler())
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{*s.tlsCert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		name        string
+		fingerprint string
+		wantErr     bool
+	}{
+		{"wrong fingerprint", strings.Repeat("00:", 31) + "00", true},
+		{"server fingerprint", s.Fingerprint(), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: t.TempDir(), Fingerprint: tt.fingerprint})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); (err != nil) != tt.wantErr {
+				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	if err := statusError(http.StatusUnauthorized); !strings.Contains(err.Error(), "pairing code") {
+		t.Errorf("statusError(401) = %v, want a pairing code hint", err)
+	}
+	if err := statusError(http.StatusNotFound); err.Error() != "server returned 404" {
+		t.Errorf("statusError(404) = %v", err)
+	}
+}
+
+func TestPlanMerge(t *testing.T) {
+	base := map[string]string{"same": "h", "local-edit": "h", "server-edit": "h", "both-edit": "h", "local-del": "h", "server-del": "h"}
+	local := map[string]string{"same": "h", "local-edit": "L", "server-edit": "h", "both-edit": "L", "server-del": "h", "new-local": "n"}
+	server := map[string]string{"same": "h", "local-edit": "h", "server-edit": "S", "both-edit": "S", "local-del": "h", "new-server": "n"}
+
+	plan := planMerge(local, server, base, true)
+	check := func(name string, got, want []string) {
+		if !equalSets(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	check("Pull", plan.Pull, []string{"server-edit", "new-server"})
+	check("Push", plan.Push, []string{"local-edit", "new-local"})
+	check("DeleteLocal", plan.DeleteLocal, []string{"server-del"})
+	check("DeleteRemote", plan.DeleteRemote, []string{"local-del"})
+	check("Conflicts", plan.Conflicts, []string{"both-edit"})
+
+	// Without --delete, deletions are undone by copying the file back.
+	plan = planMerge(local, server, base, false)
+	check("Pull without delete", plan.Pull, []string{"server-edit", "new-server", "local-del"})
+	check("Push without delete", plan.Push, []string{"local-edit", "new-local", "server-del"})
+
+	// With no base, any differing path is a conflict rather than an overwrite.
+	plan = planMerge(map[string]string{"a": "1"}, map[string]string{"a": "2"}, map[string]string{}, true)
+	check("Conflicts without base", plan.Conflicts, []string{"a"})
+}
+
+func TestClientServerMerge(t *testing.T) {
+	localDir, serverDir := t.TempDir(), t.TempDir()
+	writeFixture(t, localDir, "shared.txt", "v1")
+	writeFixture(t, localDir, "local-only.txt", "from client")
+	writeFixture(t, serverDir, "shared.txt", "v1")
+	writeFixture(t, serverDir, "server-only.txt", "from server")
+
+	home := t.TempDir()
+	runMerge := func() {
+		t.Helper()
+		ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "both", DeleteExtra: true})
+		t.Setenv("HOME", home)
+		c, err := NewClient(ClientConfig{ServerAddr: "http://fs-sync.test", SyncDir: localDir, DeleteExtra: true})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		// Keep the base manifest key stable across test servers on new ports.
+		c.httpClient.Transport = rewriteHostTransport{target: ts.URL}
+		if err := c.Run(ClientCallbacks{}); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+	assertSame := func(stage string) {
+		t.Helper()
+		l, _ := BuildManifest(localDir, nil, nil)
+		s, _ := BuildManifest(serverDir, nil, nil)
+		if len(l) != len(s) {
+			t.Fatalf("%s: local %v and server %v differ", stage, l, s)
+		}
+		for path, hash := range l {
+			if s[path] != hash {
+				t.Errorf("%s: %s differs between sides", stage, path)
+			}
+		}
+	}
+
+	runMerge()
+	assertSame("initial merge")
+
+	writeFixture(t, localDir, "shared.txt", "edited on client")
+	os.Remove(filepath.Join(serverDir, "server-only.txt"))
+	runMerge()
+	assertSame("one-sided changes")
+	if _, err := os.Stat(filepath.Join(localDir, "server-only.txt")); !os.IsNotExist(err) {
+		t.Error("expected server-side deletion to propagate to the client")
+	}
+
+	writeFixture(t, localDir, "shared.txt", "client version")
+	writeFixture(t, serverDir, "shared.txt", "server version")
+	runMerge()
+	assertSame("conflict")
+	host, _ := os.Hostname()
+	got, _ := os.ReadFile(filepath.Join(localDir, "shared.txt"))
+	kept, _ := os.ReadFile(filepath.Join(localDir, conflictName("shared.txt", host)))
+	if string(got) != "server version" || string(kept) != "client version" {
+		t.Errorf("after conflict got %q at path and %q in conflict copy", got, kept)
+	}
+}
+
+func TestMergeKeepsFailedPushOutOfBase(t *testing.T) {
+	localDir, serverDir := t.TempDir(), t.TempDir()
+	writeFixture(t, localDir, "shared.txt", "v1")
+	writeFixture(t, serverDir, "shared.txt", "v1")
+
+	home := t.TempDir()
+	runMerge := func(failUploads bool) {
+		t.Helper()
+		ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "both", DeleteExtra: true})
+		t.Setenv("HOME", home)
+		c, err := NewClient(ClientConfig{ServerAddr: "http://fs-sync.test", SyncDir: localDir, DeleteExtra: true})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		c.httpClient.Transport = rewriteHostTransport{target: ts.URL}
+		if failUploads {
+			c.httpClient.Transport = failUploadsTransport{next: c.httpClient.Transport}
+		}
+		if err := c.Run(ClientCallbacks{}); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+
+	runMerge(false)
+	writeFixture(t, localDir, "unpushed.txt", "only on client")
+	runMerge(true)
+	if _, err := os.Stat(filepath.Join(serverDir, "unpushed.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the upload to fail")
+	}
+
+	runMerge(false)
+	if got, err := os.ReadFile(filepath.Join(localDir, "unpushed.txt")); err != nil || string(got) != "only on client" {
+		t.Fatalf("unpushed file was not kept locally: %q, %v", got, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(serverDir, "unpushed.txt")); string(got) != "only on client" {
+		t.Errorf("server has %q after retry, want the client's file", got)
+	}
+}
+
+// failUploadsTransport fails every file upload and passes other requests on.
+type failUploadsTransport struct {
+	next http.RoundTripper
+}
+
+func (rt failUploadsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && (req.URL.Path == "/file" || req.URL.Path == "/delta") {
+		return nil, errors.New("upload refused by test")
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// rewriteHostTransport sends every request to target regardless of the URL's
+// host, so a client's configured address can stay fixed across test servers.
+type rewriteHostTransport struct {
+	target string
+}
+
+func (rt rewriteHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(rt.target)
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.URL.Scheme = u.Scheme
+	out.URL.Host = u.Host
+	return http.DefaultTransport.RoundTrip(out)
+}
+
+func TestClientWatch(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	writeFixture(t, clientDir, "a.txt", "alpha")
+	ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "receive", Watch: true})
+	c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- c.Watch(ctx, ClientCallbacks{}) }()
+
+	waitForFile := func(rel, want string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if got, err := os.ReadFile(filepath.Join(serverDir, rel)); err == nil && string(got) == want {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("%s did not reach the server", rel)
+	}
+	waitForFile("a.txt", "alpha")
+	writeFixture(t, clientDir, "sub/b.txt", "bravo")
+	waitForFile("sub/b.txt", "bravo")
+
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Errorf("Watch() error = %v", err)
+	}
+}
+
+func TestDrainEventsReportsEditsMadeDuringSync(t *testing.T) {
+	clientDir := t.TempDir()
+	c, err := NewClient(ClientConfig{ServerAddr: "http://127.0.0.1:0", SyncDir: clientDir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+	defer watcher.Close()
+	if err := c.addWatches(watcher, clientDir); err != nil {
+		t.Fatalf("addWatches() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want bool
+	}{
+		{"partial file", "a.txt" + partialSuffix, false},
+		{"user edit", "b.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFixture(t, clientDir, tt.file, "data")
+			// The watcher hands over one event at a time, so keep draining
+			// until the events of this write have all arrived.
+			got := false
+			for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+				got = c.drainEvents(watcher) || got
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got != tt.want {
+				t.Errorf("drainEvents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientServerMetadata(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and permission bits differ on Windows")
+	}
+	for _, mode := range []string{"send", "receive"} {
+		t.Run(mode, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			writeFixture(t, srcDir, "bin/run.sh", "#!/bin/sh\n")
+			writeFixture(t, srcDir, "same.txt", "same")
+			writeFixture(t, dstDir, "same.txt", "same")
+			for _, rel := range []string{"bin/run.sh", "same.txt"} {
+				full := filepath.Join(srcDir, rel)
+				if err := os.Chmod(full, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(full, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink("run.sh", filepath.Join(srcDir, "bin", "run")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(srcDir, "empty", "nested"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: mode})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			for _, rel := range []string{"bin/run.sh", "same.txt"} {
+				info, err := os.Stat(filepath.Join(dstDir, rel))
+				if err != nil {
+					t.Fatalf("%s missing: %v", rel, err)
+				}
+				if info.Mode().Perm() != 0755 {
+					t.Errorf("%s mode = %v, want 0755", rel, info.Mode().Perm())
+				}
+				if !info.ModTime().Equal(mtime) {
+					t.Errorf("%s mtime = %v, want %v", rel, info.ModTime(), mtime)
+				}
+			}
+			if target, err := os.Readlink(filepath.Join(dstDir, "bin", "run")); err != nil || target != "run.sh" {
+				t.Errorf("bin/run link = %q (err %v), want run.sh", target, err)
+			}
+			if info, err := os.Stat(filepath.Join(dstDir, "empty", "nested")); err != nil || !info.IsDir() {
+				t.Errorf("empty/nested directory not created: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryOverLoopback(t *testing.T) {
+	lo, err := loopbackInterface()
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	s, err := NewServer(ServerConfig{SyncDir: t.TempDir(), Mode: "receive", Port: 45873, PairingCode: "ABCD-EFGH"})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	mdnsServer, err := s.advertise(lo, []net.IP{net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer mdnsServer.Shutdown()
+
+	servers, err := discover(context.Background(), lo, time.Second)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	for _, got := range servers {
+		if got.URL == "http://127.0.0.1:45873" {
+			if got.Mode != "receive" || !got.Auth || got.Fingerprint != "" {
+				t.Errorf("discover() = %+v", got)
+			}
+			return
+		}
+	}
+	t.Errorf("discover() = %v, want the advertised server", servers)
+}
+
+func loopbackInterface() (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return &iface, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func TestClientServerCompression(t *testing.T) {
+	for _, mode := range []string{"send", "receive"} {
+		t.Run(mode, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			writeFixture(t, srcDir, "dump.json", strings.Repeat(`{"key": "value"},`, 1<<14))
+			writeFixture(t, srcDir, "archive.zip", "not really a zip")
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: mode})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			var summary string
+			if err := c.Run(ClientCallbacks{OnSuccess: func(msg string) { summary = msg }}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if !strings.Contains(summary, "compression") {
+				t.Errorf("summary %q does not report compression", summary)
+			}
+			srcManifest, _ := BuildManifest(srcDir, nil, nil)
+			dstManifest, _ := BuildManifest(dstDir, nil, nil)
+			for path, hash := range srcManifest {
+				if dstManifest[path] != hash {
+					t.Errorf("%s: dst hash %q, want %q", path, dstManifest[path], hash)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := map[string]bool{
+		"src/main.go":    true,
+		"data/dump.json": true,
+		"movie.MP4":      false,
+		"img/photo.webp": false,
+		"backup.zip":     false,
+	}
+	for path, want := range tests {
+		if got := compressible(path); got != want {
+			t.Errorf("compressible(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"500K", 500 << 10, false},
+		{"10m", 10 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"2MB/s", 2 << 20, false},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"-1M", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseBandwidth(%q) = %d, %v; want %d, err=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestClientServerParallel(t *testing.T) {
+	for _, mode := range []string{"send", "receive"} {
+		t.Run(mode, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			for i := range 16 {
+				writeFixture(t, srcDir, fmt.Sprintf("dir%d/file%d.bin", i%4, i), strings.Repeat(string(rune('a'+i)), 64<<10))
+			}
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: mode})
+			c, err := NewClient(ClientConfig{
+				ServerAddr:         ts.URL,
+				SyncDir:            clientDir,
+				Parallel:           4,
+				BWLimit:            2 << 20,
+				DisableCompression: true,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			var lastPercent atomic.Int64
+			start := time.Now()
+			err = c.Run(ClientCallbacks{OnProgress: func(label string, percent int) {
+				lastPercent.Store(int64(percent))
+			}})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			// 1 MiB at 2 MiB/s, less the initial burst.
+			if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+				t.Errorf("sync took %v, bandwidth limit not applied", elapsed)
+			}
+			if lastPercent.Load() == 0 {
+				t.Error("no progress reported")
+			}
+			srcManifest, _ := BuildManifest(srcDir, nil, nil)
+			dstManifest, _ := BuildManifest(dstDir, nil, nil)
+			if len(dstManifest) != len(srcManifest) {
+				t.Fatalf("dst has %d files, want %d", len(dstManifest), len(srcManifest))
+			}
+			for path, hash := range srcManifest {
+				if dstManifest[path] != hash {
+					t.Errorf("%s: dst hash %q, want %q", path, dstManifest[path], hash)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncReport(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	writeFixture(t, clientDir, "new.txt", "new")
+	writeFixture(t, clientDir, "changed.txt", "changed")
+	writeFixture(t, serverDir, "changed.txt", "stale")
+	writeFixture(t, serverDir, "extra.txt", "extra")
+
+	serverReports := make(chan *SyncReport, 1)
+	ts := startTestServer(t, ServerConfig{
+		SyncDir:     serverDir,
+		Mode:        "receive",
+		DeleteExtra: true,
+		OnReport:    func(report *SyncReport) { serverReports <- report },
+	})
+	c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, DeleteExtra: true})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	var clientReport *SyncReport
+	if err := c.Run(ClientCallbacks{OnReport: func(report *SyncReport) { clientReport = report }}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	var serverReport *SyncReport
+	select {
+	case serverReport = <-serverReports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server report not delivered")
+	}
+	for _, report := range []*SyncReport{clientReport, serverReport} {
+		if report == nil {
+			t.Fatal("client report not delivered")
+		}
+		if report.Mode != "receive" {
+			t.Errorf("%s report mode = %q, want receive", report.Role, report.Mode)
+		}
+		if strings.Join(report.Added, ",") != "new.txt" {
+			t.Errorf("%s report added = %v, want [new.txt]", report.Role, report.Added)
+		}
+		if strings.Join(report.Updated, ",") != "changed.txt" {
+			t.Errorf("%s report updated = %v, want [changed.txt]", report.Role, report.Updated)
+		}
+		if strings.Join(report.Deleted, ",") != "extra.txt" {
+			t.Errorf("%s report deleted = %v, want [extra.txt]", report.Role, report.Deleted)
+		}
+		if len(report.Errors) != 0 {
+			t.Errorf("%s report errors = %v, want none", report.Role, report.Errors)
+		}
+		if report.Bytes != int64(len("new")+len("changed")) {
+			t.Errorf("%s report bytes = %d, want %d", report.Role, report.Bytes, len("new")+len("changed"))
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := clientReport.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+	for _, key := range []string{"added", "updated", "deleted", "skipped", "errors", "bytes", "duration_seconds"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("report JSON missing %q", key)
+		}
+	}
+}
+
+func TestReceiveRejectsChecksumMismatch(t *testing.T) {
+	serverDir := t.TempDir()
+	writeFixture(t, serverDir, "keep.txt", "original")
+	reports := make(chan *SyncReport, 1)
+	ts := startTestServer(t, ServerConfig{
+		SyncDir:  serverDir,
+		Mode:     "receive",
+		Watch:    true,
+		OnReport: func(report *SyncReport) { reports <- report },
+	})
+	put := func(hash string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/file?path=keep.txt", strings.NewReader("corrupted"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != "" {
+			req.Header.Set(hashHeader, hash)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT error = %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := put(""); status != http.StatusBadRequest {
+		t.Errorf("PUT without checksum status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := put(strings.Repeat("0", 64)); status != http.StatusUnprocessableEntity {
+		t.Errorf("PUT with wrong checksum status = %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	got, err := os.ReadFile(filepath.Join(serverDir, "keep.txt"))
+	if err != nil || string(got) != "original" {
+		t.Errorf("keep.txt = %q, %v; want original contents kept", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(serverDir, "keep.txt"+partialSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expected mismatching partial to be discarded, stat err = %v", err)
+	}
+
+	resp, err := http.Post(ts.URL+"/done", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("POST /done error = %v", err)
+	}
+	resp.Body.Close()
+	report := <-reports
+	if strings.Join(report.Mismatches, ",") != "keep.txt" {
+		t.Errorf("report mismatches = %v, want [keep.txt]", report.Mismatches)
+	}
+	if len(report.Added)+len(report.Updated) != 0 {
+		t.Errorf("report lists rejected file as transferred: added=%v updated=%v", report.Added, report.Updated)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	writeFixture(t, dir, "state.json", "old")
+	if err := writeFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("writeFileAtomic() error = %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "new" {
+		t.Errorf("state.json = %q, %v; want new", got, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only state.json in dir, found %d entries", len(entries))
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0600 {
+			t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+		}
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	writeFixture(t, serverDir, "changed.txt", "new")
+	writeFixture(t, serverDir, "added.txt", "added")
+	writeFixture(t, clientDir, "changed.txt", "old")
+	writeFixture(t, clientDir, "extra/gone.txt", "gone")
+
+	ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "send", Watch: true})
+	c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, DeleteExtra: true, BackupDir: DefaultBackupDir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := c.Run(ClientCallbacks{}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// A second run must not sync or delete the backup directory itself.
+	if err := c.Run(ClientCallbacks{}); err != nil {
+		t.Fatalf("second Run() error = %v", err)
+	}
+
+	sessions, err := TrashSessions(clientDir, DefaultBackupDir)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("TrashSessions() = %v, %v; want one session", sessions, err)
+	}
+	kept, err := os.ReadFile(filepath.Join(clientDir, DefaultBackupDir, sessions[0], "changed.txt"))
+	if err != nil || string(kept) != "old" {
+		t.Errorf("backup of changed.txt = %q, %v; want old", kept, err)
+	}
+	if _, err := os.Stat(filepath.Join(clientDir, DefaultBackupDir, sessions[0], "extra", "gone.txt")); err != nil {
+		t.Errorf("expected deleted file in backup: %v", err)
+	}
+
+	result, err := Restore(clientDir, DefaultBackupDir, sessions[0])
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if strings.Join(result.Removed, ",") != "added.txt" {
+		t.Errorf("Restore() removed %v, want [added.txt]", result.Removed)
+	}
+	for path, want := range map[string]string{"changed.txt": "old", "extra/gone.txt": "gone"} {
+		got, err := os.ReadFile(filepath.Join(clientDir, path))
+		if err != nil || string(got) != want {
+			t.Errorf("%s after restore = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(clientDir, "added.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected added.txt removed by restore, stat err = %v", err)
+	}
+	// The restore is itself kept as a session, replacing the one it undid.
+	sessions, _ = TrashSessions(clientDir, DefaultBackupDir)
+	if len(sessions) != 1 {
+		t.Fatalf("sessions after restore = %v, want one undo session", sessions)
+	}
+	if got, err := os.ReadFile(filepath.Join(clientDir, DefaultBackupDir, sessions[0], "changed.txt")); err != nil || string(got) != "new" {
+		t.Errorf("undo session changed.txt = %q, %v; want new", got, err)
+	}
+}
+
+// TestMoveByCopy covers the fallback for a backup directory on another
+// filesystem, where rename fails.
+func TestMoveByCopy(t *testing.T) {
+	src, dst := filepath.Join(t.TempDir(), "tree"), filepath.Join(t.TempDir(), "kept")
+	writeFixture(t, src, "a.txt", "alpha")
+	writeFixture(t, src, "nested/b.txt", "beta")
+	if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveByCopy(src, dst); err != nil {
+		t.Fatalf("moveByCopy() error = %v", err)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("expected source removed, lstat err = %v", err)
+	}
+	for rel, want := range map[string]string{"a.txt": "alpha", "nested/b.txt": "beta"} {
+		if got, _ := os.ReadFile(filepath.Join(dst, rel)); string(got) != want {
+			t.Errorf("%s = %q, want %q", rel, got, want)
+		}
+	}
+	if got, err := os.Readlink(filepath.Join(dst, "link")); err != nil || got != "a.txt" {
+		t.Errorf("link = %q, %v; want a.txt", got, err)
+	}
+
+	// A single file moves the same way.
+	file := filepath.Join(t.TempDir(), "c.txt")
+	writeFixture(t, filepath.Dir(file), "c.txt", "gamma")
+	if err := moveByCopy(file, filepath.Join(dst, "c.txt")); err != nil {
+		t.Fatalf("moveByCopy(file) error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "c.txt")); string(got) != "gamma" {
+		t.Errorf("c.txt = %q, want gamma", got)
+	}
+}
+
+func TestFanOutToMultipleClients(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	serverDir := t.TempDir()
+	for i := range 8 {
+		writeFixture(t, serverDir, fmt.Sprintf("data/part%d.bin", i), strings.Repeat(string(rune('a'+i)), 32<<10))
+	}
+	var mu sync.Mutex
+	var reports []*SyncReport
+	s, err := NewServer(ServerConfig{
+		SyncDir:    serverDir,
+		Mode:       "send",
+		MaxClients: 3,
+		OnReport: func(report *SyncReport) {
+			mu.Lock()
+			reports = append(reports, report)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	clientDirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	run := func(dir string) error {
+		c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: dir, Parallel: 2})
+		if err != nil {
+			return err
+		}
+		return c.Run(ClientCallbacks{})
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range 2 {
+		wg.Go(func() { errs[i] = run(clientDirs[i]) })
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+	select {
+	case <-s.serveDone:
+		t.Fatal("server stopped before serving --max-clients clients")
+	default:
+	}
+	if err := run(clientDirs[2]); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	select {
+	case <-s.serveDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after its last client")
+	}
+
+	srcManifest, _ := BuildManifest(serverDir, nil, nil)
+	for _, dir := range clientDirs {
+		dstManifest, _ := BuildManifest(dir, nil, nil)
+		if len(dstManifest) != len(srcManifest) {
+			t.Errorf("%s has %d files, want %d", dir, len(dstManifest), len(srcManifest))
+		}
+	}
+	if len(reports) != 3 {
+		t.Fatalf("got %d server reports, want one per client", len(reports))
+	}
+	for _, report := range reports {
+		if len(report.Sent) != len(srcManifest) {
+			t.Errorf("report sent %d files, want %d", len(report.Sent), len(srcManifest))
+		}
+	}
+}
+
+func TestServerExpiresIdleSessions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var reports []*SyncReport
+	s, err := NewServer(ServerConfig{SyncDir: t.TempDir(), Mode: "send", OnReport: func(r *SyncReport) { reports = append(reports, r) }})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+	for _, id := range []string{"gone", "busy"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/manifest", nil)
+		req.Header.Set(clientHeader, id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /manifest error = %v", err)
+		}
+		resp.Body.Close()
+	}
+	s.sessions["busy"].active.Add(1)
+
+	s.expireIdleSessions(time.Now().Add(requestTimeout / 2))
+	if len(s.sessions) != 2 || len(reports) != 0 {
+		t.Fatalf("sessions expired early: %d left, %d reports", len(s.sessions), len(reports))
+	}
+	s.expireIdleSessions(time.Now().Add(2 * requestTimeout))
+	if _, ok := s.sessions["gone"]; ok || len(s.sessions) != 1 {
+		t.Errorf("expected only the idle session to expire, left %v", slices.Collect(maps.Keys(s.sessions)))
+	}
+	if len(reports) != 1 || len(reports[0].Errors) != 1 {
+		t.Fatalf("expected one report recording the expiry, got %+v", reports)
+	}
+	if s.served != 0 {
+		t.Errorf("expired session counted as served")
+	}
+}
+
+func TestServerClientLimit(t *testing.T) {
+	tests := []struct {
+		cfg  ServerConfig
+		want int
+	}{
+		{ServerConfig{}, 1},
+		{ServerConfig{MaxClients: 5}, 5},
+		{ServerConfig{Timeout: time.Minute}, 0},
+		{ServerConfig{MaxClients: 5, Timeout: time.Minute}, 5},
+		{ServerConfig{Watch: true, MaxClients: 5}, 0},
+	}
+	for _, tt := range tests {
+		s := &Server{cfg: tt.cfg}
+		if got := s.clientLimit(); got != tt.want {
+			t.Errorf("clientLimit(%+v) = %d, want %d", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestParseSizeAndAge(t *testing.T) {
+	sizes := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"100MB", 100 << 20, true},
+		{"512k", 512 << 10, true},
+		{"1.5G", 3 << 29, true},
+		{"2048", 2048, true},
+		{"", 0, false},
+		{"-1M", 0, false},
+		{"big", 0, false},
+	}
+	for _, tt := range sizes {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+	ages := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"36h", 36 * time.Hour, true},
+		{"1.5d", 36 * time.Hour, true},
+		{"", 0, false},
+		{"d", 0, false},
+		{"-3h", 0, false},
+	}
+	for _, tt := range ages {
+		got, err := ParseAge(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseAge(%q) = %v, %v; want %v, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestClientServerFilteredSync(t *testing.T) {
+	for _, mode := range []string{"send", "receive"} {
+		t.Run(mode, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			serverDir, clientDir := srcDir, dstDir
+			if mode == "receive" {
+				serverDir, clientDir = dstDir, srcDir
+			}
+			writeFixture(t, srcDir, "docs/keep.md", "keep")
+			writeFixture(t, srcDir, "docs/skip.txt", "wrong extension")
+			writeFixture(t, srcDir, "docs/huge.md", strings.Repeat("x", 4096))
+			writeFixture(t, srcDir, "docs/stale.md", "too old")
+			old := time.Now().Add(-30 * 24 * time.Hour)
+			if err := os.Chtimes(filepath.Join(srcDir, "docs/stale.md"), old, old); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(srcDir, "empty"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeFixture(t, dstDir, "local.txt", "outside the filter")
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: mode, DeleteExtra: true})
+			c, err := NewClient(ClientConfig{
+				ServerAddr:  ts.URL,
+				SyncDir:     clientDir,
+				DeleteExtra: true,
+				Filter:      Filter{Include: "*.md", MaxSize: 1024, NewerThan: 7 * 24 * time.Hour},
+			})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			dstManifest, _ := BuildManifest(dstDir, nil, nil)
+			want := map[string]bool{"docs/keep.md": true, "local.txt": true}
+			if len(dstManifest) != len(want) {
+				t.Errorf("dst files = %v, want %v", slices.Sorted(maps.Keys(dstManifest)), slices.Sorted(maps.Keys(want)))
+			}
+			for path := range want {
+				if _, ok := dstManifest[path]; !ok {
+					t.Errorf("expected %s on receiver", path)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "empty")); !os.IsNotExist(err) {
+				t.Errorf("expected empty directory left out of a filtered sync, stat err = %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteSkipsPathsFilteredOnOtherSide(t *testing.T) {
+	big := strings.Repeat("x", 4096)
+	for _, tc := range []struct {
+		name                 string
+		serverCopy, local    string
+		serverFilter, filter Filter
+	}{
+		// The local copy passes the client's filter, the server's does not.
+		{"client filter", "small", big, Filter{}, Filter{MinSize: 1024}},
+		// The server's own filter leaves its copy out of the manifest.
+		{"server filter", big, "small", Filter{MaxSize: 1024}, Filter{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverDir, clientDir := t.TempDir(), t.TempDir()
+			writeFixture(t, serverDir, "data.bin", tc.serverCopy)
+			writeFixture(t, clientDir, "data.bin", tc.local)
+			writeFixture(t, clientDir, "extra.bin", big)
+
+			ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "send", Filter: tc.serverFilter})
+			c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, DeleteExtra: true, Filter: tc.filter})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := c.Run(ClientCallbacks{}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(clientDir, "data.bin")); string(got) != tc.local {
+				t.Error("expected data.bin kept: the server still holds it")
+			}
+			if _, err := os.Stat(filepath.Join(clientDir, "extra.bin")); !os.IsNotExist(err) {
+				t.Errorf("expected extra.bin deleted, stat err = %v", err)
+			}
+		})
+	}
+}
+
+func TestExportImportBundle(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, name := range []string{"sync.tar.gz", "sync.zip", "sync.tar"} {
+		t.Run(name, func(t *testing.T) {
+			srcDir, dstDir, bundleDir := t.TempDir(), t.TempDir(), t.TempDir()
+			writeFixture(t, srcDir, "same.txt", "same")
+			writeFixture(t, srcDir, "changed.txt", "new")
+			writeFixture(t, srcDir, "nested/added.bin", strings.Repeat("x", 4096))
+			writeFixture(t, dstDir, "same.txt", "same")
+			writeFixture(t, dstDir, "changed.txt", "old")
+			writeFixture(t, dstDir, "extra.txt", "extra")
+
+			manifestPath := filepath.Join(bundleDir, "manifest.tar")
+			dst, err := NewClient(ClientConfig{SyncDir: dstDir, DeleteExtra: true})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := dst.Export(manifestPath, "", true, ClientCallbacks{}); err != nil {
+				t.Fatalf("Export(manifest-only) error = %v", err)
+			}
+			index, err := readBundleIndex(manifestPath)
+			if err != nil || len(index.Files) != 0 || len(index.Manifest.Files) != 3 {
+				t.Fatalf("manifest-only index = %+v, %v", index, err)
+			}
+
+			bundlePath := filepath.Join(bundleDir, name)
+			src, err := NewClient(ClientConfig{SyncDir: srcDir})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			if err := src.Export(bundlePath, manifestPath, false, ClientCallbacks{}); err != nil {
+				t.Fatalf("Export() error = %v", err)
+			}
+			if index, err = readBundleIndex(bundlePath); err != nil {
+				t.Fatalf("readBundleIndex() error = %v", err)
+			}
+			if got := strings.Join(index.Files, ","); got != "changed.txt,nested/added.bin" {
+				t.Errorf("bundled files = %s, want only the changed and added ones", got)
+			}
+
+			var report *SyncReport
+			if err := dst.Import(bundlePath, ClientCallbacks{OnReport: func(r *SyncReport) { report = r }}); err != nil {
+				t.Fatalf("Import() error = %v", err)
+			}
+			for path, want := range map[string]string{"same.txt": "same", "changed.txt": "new", "nested/added.bin": strings.Repeat("x", 4096)} {
+				if got, err := os.ReadFile(filepath.Join(dstDir, path)); err != nil || string(got) != want {
+					t.Errorf("%s after import = %q, %v; want %q", path, got, err, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "extra.txt")); !os.IsNotExist(err) {
+				t.Errorf("expected extra.txt deleted, stat err = %v", err)
+			}
+			if report == nil || report.Mode != "import" || len(report.Added) != 1 || len(report.Updated) != 1 || len(report.Deleted) != 1 {
+				t.Errorf("import report = %+v", report)
+			}
+		})
+	}
+}
+
+func TestImportStaleBundle(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	srcDir, dstDir, bundleDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFixture(t, srcDir, "a.txt", "a")
+	writeFixture(t, srcDir, "b.txt", "b")
+	writeFixture(t, dstDir, "b.txt", "b")
+
+	// Exported against a manifest that claims the destination already holds
+	// a.txt, so the bundle lacks it.
+	manifestPath := filepath.Join(bundleDir, "manifest.tar")
+	src, err := NewClient(ClientConfig{SyncDir: srcDir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := src.Export(manifestPath, "", true, ClientCallbacks{}); err != nil {
+		t.Fatalf("Export(manifest-only) error = %v", err)
+	}
+	bundlePath := filepath.Join(bundleDir, "sync.tgz")
+	if err := src.Export(bundlePath, manifestPath, false, ClientCallbacks{}); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	dst, err := NewClient(ClientConfig{SyncDir: dstDir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	var report *SyncReport
+	if err := dst.Import(bundlePath, ClientCallbacks{OnReport: func(r *SyncReport) { report = r }}); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if report == nil || len(report.Errors) != 1 || report.Errors[0].Path != "a.txt" {
+		t.Errorf("import report errors = %+v, want a.txt missing from bundle", report)
+	}
+	if err := dst.Import(filepath.Join(bundleDir, "missing.zip"), ClientCallbacks{}); err == nil {
+		t.Error("Import() of a missing bundle succeeded")
+	}
+}
+
+func TestClientServerRemotePath(t *testing.T) {
+	t.Run("pull", func(t *testing.T) {
+		serverDir, clientDir := t.TempDir(), t.TempDir()
+		writeFixture(t, serverDir, "photos/2025/a.jpg", "a")
+		writeFixture(t, serverDir, "photos/2025/trip/b.jpg", "b")
+		writeFixture(t, serverDir, "photos/2024/old.jpg", "old")
+		writeFixture(t, serverDir, "notes.txt", "notes")
+		writeFixture(t, clientDir, "stale.jpg", "stale")
+
+		ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "send", Watch: true})
+		c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, DeleteExtra: true, RemotePath: "photos/2025/"})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		if err := c.Run(ClientCallbacks{}); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		got, _ := BuildManifest(clientDir, nil, nil)
+		if want := []string{"a.jpg", "trip/b.jpg"}; !slices.Equal(slices.Sorted(maps.Keys(got)), want) {
+			t.Errorf("client files = %v, want %v", slices.Sorted(maps.Keys(got)), want)
+		}
+	})
+
+	t.Run("push", func(t *testing.T) {
+		serverDir, clientDir := t.TempDir(), t.TempDir()
+		writeFixture(t, clientDir, "x.txt", "x")
+		writeFixture(t, serverDir, "inbox/extra.txt", "extra")
+		writeFixture(t, serverDir, "keep.txt", "keep")
+
+		ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "receive", DeleteExtra: true, Watch: true})
+		c, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: clientDir, DeleteExtra: true, RemotePath: "inbox"})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		if err := c.Run(ClientCallbacks{}); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		got, _ := BuildManifest(serverDir, nil, nil)
+		if want := []string{"inbox/x.txt", "keep.txt"}; !slices.Equal(slices.Sorted(maps.Keys(got)), want) {
+			t.Errorf("server files = %v, want %v", slices.Sorted(maps.Keys(got)), want)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		serverDir := t.TempDir()
+		ts := startTestServer(t, ServerConfig{SyncDir: serverDir, Mode: "send", Watch: true})
+		for _, remotePath := range []string{"../etc", "/etc", "."} {
+			if _, err := NewClient(ClientConfig{ServerAddr: ts.URL, SyncDir: t.TempDir(), RemotePath: remotePath}); err == nil {
+				t.Errorf("NewClient(RemotePath: %q) succeeded, want error", remotePath)
+			}
+		}
+		for query, want := range map[string]int{"../etc": http.StatusBadRequest, "missing": http.StatusNotFound} {
+			resp, err := http.Get(ts.URL + "/manifest?path=" + url.QueryEscape(query))
+			if err != nil {
+				t.Fatalf("GET /manifest error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("GET /manifest?path=%s = %d, want %d", query, resp.StatusCode, want)
+			}
+		}
+	})
+}
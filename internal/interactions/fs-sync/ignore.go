@@ -0,0 +1,162 @@
+package fssync
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Ignore files read from the sync root. .gitignore is only read on request,
+// below .nitsignore in precedence; patterns from --ignore are applied last.
+const (
+	gitIgnoreFile  = ".gitignore"
+	nitsIgnoreFile = ".nitsignore"
+)
+
+// PathIgnorer matches slash-separated paths relative to the sync root against
+// gitignore-style rules. As in git, the last matching rule wins, and nothing
+// below an ignored directory can be re-included.
+type PathIgnorer struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// NewPathIgnorer builds an ignorer from comma-separated patterns as given to
+// --ignore.
+func NewPathIgnorer(ignoreStr string) *PathIgnorer {
+	pi := &PathIgnorer{}
+	for _, part := range strings.Split(ignoreStr, ",") {
+		pi.addPattern(strings.TrimSpace(part))
+	}
+	return pi
+}
+
+// LoadPathIgnorer reads the .nitsignore file in rootDir, and its .gitignore
+// too when gitignore is set, and appends the --ignore patterns on top.
+// Missing files are skipped.
+func LoadPathIgnorer(rootDir, ignoreStr string, gitignore bool) (*PathIgnorer, error) {
+	pi := &PathIgnorer{}
+	files := []string{nitsIgnoreFile}
+	if gitignore {
+		files = []string{gitIgnoreFile, nitsIgnoreFile}
+	}
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(rootDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			pi.addPattern(scanner.Text())
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pi.rules = append(pi.rules, NewPathIgnorer(ignoreStr).rules...)
+	return pi, nil
+}
+
+// addPattern parses one gitignore line: blank lines and comments are skipped,
+// "!" negates, a trailing "/" matches directories only, and a pattern with a
+// "/" anywhere else is anchored to the root instead of matching at any depth.
+func (pi *PathIgnorer) addPattern(line string) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	rule.segments = strings.Split(line, "/")
+	if !anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	pi.rules = append(pi.rules, rule)
+}
+
+// Match reports whether the entry at relPath itself is ignored, without
+// looking at its parent directories. Walks use it with filepath.SkipDir.
+func (pi *PathIgnorer) Match(relPath string, isDir bool) bool {
+	segments := strings.Split(relPath, "/")
+	ignored := false
+	for _, rule := range pi.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rule.segments, segments) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// IsIgnored reports whether the file at relPath is ignored, either directly
+// or because one of its parent directories is.
+func (pi *PathIgnorer) IsIgnored(relPath string) bool {
+	if pi == nil || len(pi.rules) == 0 {
+		return false
+	}
+	relPath = strings.Trim(path.Clean(relPath), "/")
+	for i := range len(relPath) {
+		if relPath[i] == '/' && pi.Match(relPath[:i], true) {
+			return true
+		}
+	}
+	return pi.Match(relPath, false)
+}
+
+// matchSegments matches pattern segments against path segments, where "**"
+// spans any number of whole segments. A trailing "**" needs at least one, so
+// "logs/**" matches what is inside logs but not logs itself.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(segments) > 0
+		}
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
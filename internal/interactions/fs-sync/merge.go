@@ -0,0 +1,234 @@
+package fssync
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const conflictInfix = ".conflict-"
+
+// mergePlan is what a two-way sync will do, derived from the local and server
+// manifests and the base manifest recorded after the previous sync.
+type mergePlan struct {
+	Pull         []string
+	Push         []string
+	DeleteLocal  []string
+	DeleteRemote []string
+	Conflicts    []string
+}
+
+// planMerge compares each path against the base: a side that still matches
+// the base takes the other side's change (including deletions when
+// deleteExtra is set), while paths changed on both sides are conflicts.
+// Without --delete, a deletion on one side is undone by copying the file back.
+func planMerge(local, server, base map[string]string, deleteExtra bool) mergePlan {
+	var plan mergePlan
+	paths := make(map[string]bool, len(local)+len(server))
+	for path := range local {
+		paths[path] = true
+	}
+	for path := range server {
+		paths[path] = true
+	}
+	for path := range paths {
+		localHash, inLocal := local[path]
+		serverHash, inServer := server[path]
+		baseHash, inBase := base[path]
+		switch {
+		case inLocal && inServer:
+			switch {
+			case localHash == serverHash:
+			case inBase && localHash == baseHash:
+				plan.Pull = append(plan.Pull, path)
+			case inBase && serverHash == baseHash:
+				plan.Push = append(plan.Push, path)
+			default:
+				plan.Conflicts = append(plan.Conflicts, path)
+			}
+		case inLocal:
+			if inBase && localHash == baseHash && deleteExtra {
+				plan.DeleteLocal = append(plan.DeleteLocal, path)
+			} else {
+				plan.Push = append(plan.Push, path)
+			}
+		case inServer:
+			if inBase && serverHash == baseHash && deleteExtra {
+				plan.DeleteRemote = append(plan.DeleteRemote, path)
+			} else {
+				plan.Pull = append(plan.Pull, path)
+			}
+		}
+	}
+	for _, list := range [][]string{plan.Pull, plan.Push, plan.DeleteLocal, plan.DeleteRemote, plan.Conflicts} {
+		sort.Strings(list)
+	}
+	return plan
+}
+
+// mergedBase is the base to record after a merge: paths that already matched,
+// were pulled or were pushed. Any other path still on either side keeps its
+// old base entry, so a failed transfer or delete, or a delete skipped because
+// the other side only filtered the path out, is judged the same way next run
+// instead of reading the unsynced side as unchanged. Deleted paths drop out;
+// remote deletes the server refused are pulled back next time.
+func mergedBase(base, local, server map[string]string, plan mergePlan, pulled, pushed, deleted []string) map[string]string {
+	next := make(map[string]string, len(local))
+	for path, hash := range base {
+		_, inLocal := local[path]
+		_, inServer := server[path]
+		if inLocal || inServer {
+			next[path] = hash
+		}
+	}
+	for path, hash := range local {
+		if serverHash, ok := server[path]; ok && serverHash == hash {
+			next[path] = hash
+		}
+	}
+	for _, path := range deleted {
+		delete(next, path)
+	}
+	for _, path := range plan.DeleteRemote {
+		delete(next, path)
+	}
+	for _, path := range pulled {
+		next[path] = server[path]
+	}
+	for _, path := range pushed {
+		next[path] = local[path]
+	}
+	return next
+}
+
+// conflictName is where the local version of a conflicting path is kept on
+// both sides, while the server's version stays at the original path.
+func conflictName(path, host string) string {
+	host = strings.NewReplacer("/", "_", "\\", "_", " ", "_").Replace(host)
+	return path + conflictInfix + host
+}
+
+// mergeWithServer runs a two-way sync against a server in "both" mode.
+func (c *Client) mergeWithServer(cb ClientCallbacks) error {
+	serverManifest, err := c.fetchManifest()
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	filteredServer := c.filterManifest(serverManifest)
+	localManifest, err := c.localManifest()
+	if err != nil {
+		return fmt.Errorf("failed to build local manifest: %w", err)
+	}
+	// Each remote path merges against a base of its own.
+	serverKey := c.cfg.ServerAddr
+	if c.cfg.RemotePath != "" {
+		serverKey += "/" + c.cfg.RemotePath
+	}
+	basePath, err := baseManifestPath(c.cfg.SyncDir, serverKey)
+	if err != nil {
+		return fmt.Errorf("failed to locate base manifest: %w", err)
+	}
+	base := loadBaseManifest(basePath)
+	plan := planMerge(localManifest.Files, filteredServer.Files, base, c.cfg.DeleteExtra)
+	plan.Push = slices.DeleteFunc(plan.Push, func(path string) bool { return filteredBy(serverManifest, path) })
+	plan.DeleteLocal = notHeldBy(plan.DeleteLocal, serverManifest)
+	plan.DeleteRemote = notHeldBy(plan.DeleteRemote, localManifest)
+
+	if c.cfg.DryRun {
+		for _, path := range plan.Pull {
+			cb.generic(fmt.Sprintf("Dry Run (pull): %s", path))
+			c.report.skipped(path)
+		}
+		for _, path := range plan.Push {
+			cb.generic(fmt.Sprintf("Dry Run (push): %s", path))
+			c.report.skipped(path)
+		}
+		for _, path := range plan.DeleteLocal {
+			cb.generic(fmt.Sprintf("Dry Run (delete local): %s", path))
+			c.report.skipped(path)
+		}
+		for _, path := range plan.DeleteRemote {
+			cb.generic(fmt.Sprintf("Dry Run (delete remote): %s", path))
+			c.report.skipped(path)
+		}
+		for _, path := range plan.Conflicts {
+			cb.generic(fmt.Sprintf("Dry Run (conflict): %s", path))
+			c.report.skipped(path)
+		}
+		totalCount := len(plan.Pull) + len(plan.Push) + len(plan.DeleteLocal) + len(plan.DeleteRemote) + len(plan.Conflicts)
+		if totalCount == 0 {
+			cb.warn("no files would be synced", nil)
+		} else {
+			cb.success(fmt.Sprintf("%d file(s) would be synced", totalCount))
+		}
+		return c.sendDone(DoneRequest{})
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "client"
+	}
+	toPull := append([]string(nil), plan.Pull...)
+	toPush := append([]string(nil), plan.Push...)
+	for _, path := range plan.Conflicts {
+		// Keep our version under a conflict name on both sides, then take the
+		// server's version at the original path.
+		renamed := conflictName(path, host)
+		src, err := resolveSyncPath(c.cfg.SyncDir, path)
+		if err != nil {
+			continue
+		}
+		dst, err := resolveSyncPath(c.cfg.SyncDir, renamed)
+		if err != nil {
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			cb.err(fmt.Sprintf("Failed to keep conflicting %s", path), err)
+			c.report.failed(path, err)
+			continue
+		}
+		cb.warn(fmt.Sprintf("Conflict: %s (local copy kept as %s)", path, renamed), nil)
+		c.report.conflict(path)
+		localManifest.Files[renamed] = localManifest.Files[path]
+		localManifest.Meta[renamed] = localManifest.Meta[path]
+		delete(localManifest.Files, path)
+		delete(localManifest.Meta, path)
+		toPull = append(toPull, path)
+		toPush = append(toPush, renamed)
+	}
+
+	pulled := c.pullFiles(toPull, filteredServer, localManifest, cb)
+	pushed := c.pushFiles(toPush, localManifest, filteredServer, cb)
+	c.applyServerMeta(pulled, filteredServer, cb)
+	pushedMeta := make(map[string]FileMeta, len(pushed))
+	for _, path := range pushed {
+		pushedMeta[path] = localManifest.Meta[path]
+	}
+	var deleted []string
+	if c.cfg.DeleteExtra && len(plan.DeleteLocal) > 0 {
+		deleted, _ = c.deleteLocalFiles(plan.DeleteLocal, cb)
+	}
+	doneReq := DoneRequest{Files: pushed, ToDelete: plan.DeleteRemote, Meta: pushedMeta, Dirs: localManifest.Dirs}
+	if err := c.sendDone(doneReq); err != nil {
+		return fmt.Errorf("failed to finish sync: %w", err)
+	}
+	for _, path := range plan.DeleteRemote {
+		c.report.deleted(path)
+	}
+
+	// Record only what both sides now agree on as the base for the next run.
+	next := mergedBase(base, localManifest.Files, filteredServer.Files, plan, pulled, pushed, deleted)
+	if err := saveBaseManifest(basePath, next); err != nil {
+		cb.warn("Failed to save base manifest", err)
+	}
+
+	totalCount := len(pulled) + len(pushed) + len(deleted) + len(plan.DeleteRemote)
+	if totalCount == 0 {
+		cb.warn("no files were synced", nil)
+	} else {
+		cb.success(fmt.Sprintf("%d file(s) synced (%d pulled, %d pushed, %d conflict(s))%s", totalCount, len(pulled), len(pushed), len(plan.Conflicts), c.stats.summary()))
+	}
+	return nil
+}
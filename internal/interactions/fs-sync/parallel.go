@@ -0,0 +1,187 @@
+package fssync
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = 250 * time.Millisecond
+
+// ParseBandwidth parses a rate such as "500K", "10M" or "1.5G" (bytes per
+// second, binary multiples) for --bwlimit. A bare number is bytes.
+func ParseBandwidth(rate string) (int64, error) {
+	n, err := ParseSize(strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(rate)), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q", rate)
+	}
+	return n, nil
+}
+
+// rateLimiter is a token bucket shared by all transfers of a client, so the
+// limit applies to the aggregate rather than per stream. A nil limiter
+// imposes no limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSec)
+	// A tenth of a second of burst keeps the rate smooth without starving
+	// reads smaller than one buffer.
+	burst := max(rate/10, 32<<10)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may pass.
+func (rl *rateLimiter) wait(n int) {
+	if rl == nil || n <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens = min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+	rl.tokens -= float64(n)
+	var delay time.Duration
+	if rl.tokens < 0 {
+		delay = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.mu.Unlock()
+	time.Sleep(delay)
+}
+
+func (rl *rateLimiter) reader(r io.Reader) io.Reader {
+	if rl == nil {
+		return r
+	}
+	return limitedReader{r: r, rl: rl}
+}
+
+func (rl *rateLimiter) writer(w io.Writer) io.Writer {
+	if rl == nil {
+		return w
+	}
+	return limitedWriter{w: w, rl: rl}
+}
+
+type limitedReader struct {
+	r  io.Reader
+	rl *rateLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	// Cap each read at the burst size so one large read cannot overshoot.
+	if len(p) > int(lr.rl.burst) {
+		p = p[:int(lr.rl.burst)]
+	}
+	n, err := lr.r.Read(p)
+	lr.rl.wait(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	w  io.Writer
+	rl *rateLimiter
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), int(lw.rl.burst))]
+		lw.rl.wait(len(chunk))
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// transferAll runs transfer for each path on up to cfg.Parallel workers,
+// reporting aggregate progress against totalBytes, and returns the paths
+// that succeeded in their original order.
+func (c *Client) transferAll(label string, paths []string, totalBytes int64, cb ClientCallbacks, transfer func(path string) bool) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	c.progress.Store(0)
+	plan := fmt.Sprintf("%d/%d", len(paths), totalBytes)
+	c.plan.Store(&plan)
+	var doneFiles atomic.Int64
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		var lastLabel string
+		lastPercent := -1
+		for {
+			select {
+			case <-stopProgress:
+				cb.progressDone()
+				return
+			case <-ticker.C:
+				percent := 100
+				if totalBytes > 0 {
+					percent = int(min(c.progress.Load()*100/totalBytes, 100))
+				}
+				progressLabel := fmt.Sprintf("%s %d/%d file(s)", label, doneFiles.Load(), len(paths))
+				if percent != lastPercent || progressLabel != lastLabel {
+					lastPercent, lastLabel = percent, progressLabel
+					cb.progress(progressLabel, percent)
+				}
+			}
+		}
+	}()
+
+	ok := make([]bool, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range max(c.cfg.Parallel, 1) {
+		wg.Go(func() {
+			for i := range jobs {
+				ok[i] = transfer(paths[i])
+				doneFiles.Add(1)
+			}
+		})
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(stopProgress)
+	<-progressDone
+
+	var succeeded []string
+	for i, path := range paths {
+		if ok[i] {
+			succeeded = append(succeeded, path)
+		}
+	}
+	return succeeded
+}
+
+// transferSize sums the sizes recorded in meta for paths, as the total for
+// the progress bar.
+func transferSize(paths []string, meta map[string]FileMeta) int64 {
+	var total int64
+	for _, path := range paths {
+		total += meta[path].Size
+	}
+	return total
+}
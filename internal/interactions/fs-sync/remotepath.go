@@ -0,0 +1,77 @@
+package fssync
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cleanRemotePath validates a client's --remote-path with the same checks the
+// server applies to every path, and normalizes it to a slash-separated path
+// without a trailing slash. An empty path selects the whole sync directory.
+func cleanRemotePath(remotePath string) (string, error) {
+	if remotePath == "" {
+		return "", nil
+	}
+	if _, err := resolveSyncPath("", remotePath); err != nil {
+		return "", err
+	}
+	return path.Clean(filepath.ToSlash(remotePath)), nil
+}
+
+// scopeManifest narrows a manifest to the entries under sub, with paths made
+// relative to it, so a client syncing only sub compares it as a whole tree.
+func scopeManifest(manifest *ManifestResponse, sub string) *ManifestResponse {
+	prefix := path.Clean(filepath.ToSlash(sub)) + "/"
+	scoped := &ManifestResponse{
+		Files: make(map[string]string),
+		Meta:  make(map[string]FileMeta),
+	}
+	for p, hash := range manifest.Files {
+		if rel, ok := strings.CutPrefix(p, prefix); ok {
+			scoped.Files[rel] = hash
+			scoped.Meta[rel] = manifest.Meta[p]
+		}
+	}
+	for _, dir := range manifest.Dirs {
+		if rel, ok := strings.CutPrefix(dir, prefix); ok {
+			scoped.Dirs = append(scoped.Dirs, rel)
+		}
+	}
+	for _, p := range manifest.Filtered {
+		if rel, ok := strings.CutPrefix(p, prefix); ok {
+			scoped.Filtered = append(scoped.Filtered, rel)
+		}
+	}
+	return scoped
+}
+
+// remotePath maps a path relative to the local sync directory to the server's
+// path for it.
+func (c *Client) remotePath(p string) string {
+	if c.cfg.RemotePath == "" {
+		return p
+	}
+	return c.cfg.RemotePath + "/" + p
+}
+
+// remoteDone maps the paths in a /done request to the server's paths.
+func (c *Client) remoteDone(doneReq DoneRequest) DoneRequest {
+	if c.cfg.RemotePath == "" {
+		return doneReq
+	}
+	mapped := DoneRequest{Meta: make(map[string]FileMeta, len(doneReq.Meta))}
+	for _, p := range doneReq.Files {
+		mapped.Files = append(mapped.Files, c.remotePath(p))
+	}
+	for _, p := range doneReq.ToDelete {
+		mapped.ToDelete = append(mapped.ToDelete, c.remotePath(p))
+	}
+	for p, meta := range doneReq.Meta {
+		mapped.Meta[c.remotePath(p)] = meta
+	}
+	for _, dir := range doneReq.Dirs {
+		mapped.Dirs = append(mapped.Dirs, c.remotePath(dir))
+	}
+	return mapped
+}
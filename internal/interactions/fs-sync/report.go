@@ -0,0 +1,133 @@
+package fssync
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncReport summarises one sync session from the point of view of the side
+// that wrote it. Added and Updated are paths written on the receiving side,
+// Sent lists what a send-mode server served, and Skipped holds paths that
+// were planned but not transferred (dry runs, ignored paths). Mismatches
+// are files rejected because the received data did not hash to the sender's
+// manifest entry; they also appear in Errors.
+type SyncReport struct {
+	mu sync.Mutex
+
+	Role       string        `json:"role"`
+	Mode       string        `json:"mode"`
+	DryRun     bool          `json:"dry_run"`
+	StartedAt  time.Time     `json:"started_at"`
+	Duration   float64       `json:"duration_seconds"`
+	Added      []string      `json:"added"`
+	Updated    []string      `json:"updated"`
+	Deleted    []string      `json:"deleted"`
+	Skipped    []string      `json:"skipped"`
+	Sent       []string      `json:"sent,omitempty"`
+	Conflicts  []string      `json:"conflicts,omitempty"`
+	Mismatches []string      `json:"checksum_mismatches,omitempty"`
+	Errors     []ReportError `json:"errors"`
+	Bytes      int64         `json:"bytes"`
+	WireBytes  int64         `json:"wire_bytes,omitempty"`
+}
+
+// ReportError is a failure tied to a path, or to the whole session when Path
+// is empty.
+type ReportError struct {
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+func newSyncReport(role, mode string, dryRun bool) *SyncReport {
+	return &SyncReport{Role: role, Mode: mode, DryRun: dryRun, StartedAt: time.Now()}
+}
+
+func (r *SyncReport) transferred(path string, existed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existed {
+		r.Updated = append(r.Updated, path)
+	} else {
+		r.Added = append(r.Added, path)
+	}
+}
+
+func (r *SyncReport) sent(path string, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Sent = append(r.Sent, path)
+	r.Bytes += n
+}
+
+func (r *SyncReport) deleted(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Deleted = append(r.Deleted, path)
+}
+
+func (r *SyncReport) skipped(paths ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, paths...)
+}
+
+func (r *SyncReport) conflict(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Conflicts = append(r.Conflicts, path)
+}
+
+func (r *SyncReport) failed(path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, ReportError{Path: path, Error: err.Error()})
+	if path != "" && errors.Is(err, errHashMismatch) {
+		r.Mismatches = append(r.Mismatches, path)
+	}
+}
+
+func (r *SyncReport) addBytes(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Bytes += n
+}
+
+// finish stamps the duration and sorts the path lists so reports diff cleanly.
+func (r *SyncReport) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Duration = time.Since(r.StartedAt).Seconds()
+	for _, list := range [][]string{r.Added, r.Updated, r.Deleted, r.Skipped, r.Sent, r.Conflicts, r.Mismatches} {
+		sort.Strings(list)
+	}
+	// Empty lists encode as [] rather than null for simpler consumers.
+	for _, list := range []*[]string{&r.Added, &r.Updated, &r.Deleted, &r.Skipped} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	if r.Errors == nil {
+		r.Errors = []ReportError{}
+	}
+}
+
+// JSON encodes the report on a single line, for --for-ai output.
+func (r *SyncReport) JSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return json.Marshal(r)
+}
+
+// WriteFile saves the report as indented JSON.
+func (r *SyncReport) WriteFile(path string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
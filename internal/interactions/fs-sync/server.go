@@ -1,15 +1,18 @@
 package fssync
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,17 +23,37 @@ type ServerConfig struct {
 	Port        int
 	SyncDir     string
 	IgnorePaths string
+	Gitignore   bool
 	EnableTLS   bool
 	Mode        string
 	DeleteExtra bool
 	DryRun      bool
+	Rehash      bool
+	PairingCode string
+	CertFile    string
+	KeyFile     string
+	Watch       bool
+	Advertise   bool
+	BackupDir   string
+	Filter      Filter
+	MaxClients  int
+	Timeout     time.Duration
+	OnReport    func(report *SyncReport)
 }
 
 type Server struct {
 	cfg       ServerConfig
 	ignorer   *PathIgnorer
+	filter    *manifestFilter
+	cache     *ManifestCache
+	verifier  *requestVerifier
+	tlsCert   *tls.Certificate
 	serveDone chan struct{}
 	closeOnce sync.Once
+	mu        sync.Mutex
+	sessions  map[string]*clientSession
+	served    int
+	paired    int
 }
 
 func NewServer(cfg ServerConfig) (*Server, error) {
@@ -42,36 +65,102 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 	if _, err := os.Stat(cfg.SyncDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("sync directory does not exist: %s", cfg.SyncDir)
 	}
-	return &Server{
+	// Without a usable cache every run simply hashes the whole tree.
+	cache, err := LoadManifestCache(cfg.SyncDir, cfg.Rehash)
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Manifest cache disabled: %v", err)
+		cache = nil
+	}
+	ignorer, err := LoadPathIgnorer(cfg.SyncDir, cfg.IgnorePaths, cfg.Gitignore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	if err := ignoreBackupDir(ignorer, cfg.SyncDir, cfg.BackupDir); err != nil {
+		return nil, err
+	}
+	var verifier *requestVerifier
+	if cfg.PairingCode != "" {
+		verifier = newRequestVerifier(cfg.PairingCode)
+	}
+	s := &Server{
 		cfg:       cfg,
-		ignorer:   NewPathIgnorer(cfg.IgnorePaths),
+		ignorer:   ignorer,
+		filter:    newManifestFilter(cfg.Filter),
+		cache:     cache,
+		verifier:  verifier,
 		serveDone: make(chan struct{}),
-	}, nil
+		sessions:  make(map[string]*clientSession),
+	}
+	if cfg.EnableTLS {
+		cert, err := s.loadCert()
+		if err != nil {
+			return nil, err
+		}
+		s.tlsCert = &cert
+	}
+	return s, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the TLS certificate, for
+// clients to pin with --fingerprint. It is empty when TLS is disabled.
+func (s *Server) Fingerprint() string {
+	if s.tlsCert == nil {
+		return ""
+	}
+	return u.CertFingerprint(*s.tlsCert)
+}
+
+// sends and receives report which directions the server's mode allows;
+// "both" allows either, for two-way merges.
+func (s *Server) sends() bool {
+	return s.cfg.Mode == "send" || s.cfg.Mode == "both"
+}
+
+func (s *Server) receives() bool {
+	return s.cfg.Mode == "receive" || s.cfg.Mode == "both"
 }
 
 func (s *Server) shutdown() {
 	s.closeOnce.Do(func() { close(s.serveDone) })
 }
 
-func (s *Server) Run() error {
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mode", s.handleMode)
-	mux.HandleFunc("/manifest", s.handleManifest)
-	if s.cfg.Mode == "send" {
-		mux.HandleFunc("/files", s.handleFiles)
-	} else {
-		mux.HandleFunc("/upload", s.handleUpload)
+	mux.HandleFunc("/pair", s.handlePair)
+	mux.HandleFunc("/manifest", s.requireAuth(s.tracked(s.handleManifest)))
+	mux.HandleFunc("/file", s.requireAuth(s.tracked(s.handleFile)))
+	mux.HandleFunc("/signature", s.requireAuth(s.tracked(s.handleSignature)))
+	mux.HandleFunc("/delta", s.requireAuth(s.tracked(s.handleDelta)))
+	mux.HandleFunc("/done", s.requireAuth(s.handleDone))
+	return mux
+}
+
+// requireAuth rejects requests not signed with a paired session's key. /mode
+// stays open so clients can discover that a code is needed.
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.verifier != nil && !s.verifier.verify(r) {
+			log.Printf("WARN [fs-sync-server] Rejected unauthenticated request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
 	}
+}
+
+// Run serves until ctx is cancelled, Timeout elapses or, unless the server
+// is in watch mode, the last of its clients (MaxClients, default one)
+// finishes its session.
+func (s *Server) Run(ctx context.Context) error {
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.cfg.Port),
-		Handler: mux,
+		Handler: s.handler(),
 	}
-	if s.cfg.EnableTLS {
-		tlsConfig, err := s.getTLSConfig()
-		if err != nil {
-			return fmt.Errorf("failed to get TLS config: %w", err)
+	if s.tlsCert != nil {
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*s.tlsCert},
 		}
-		server.TLSConfig = tlsConfig
 	}
 	go func() {
 		var err error
@@ -84,10 +173,30 @@ func (s *Server) Run() error {
 			log.Printf("ERROR [fs-sync-server] Server error: %v", err)
 		}
 	}()
-	<-s.serveDone
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if s.cfg.Advertise {
+		// Discovery is a convenience; the server works without it.
+		if mdnsServer, err := s.advertise(nil, nil); err != nil {
+			log.Printf("WARN [fs-sync-server] mDNS advertisement disabled: %v", err)
+		} else {
+			defer mdnsServer.Shutdown()
+		}
+	}
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	go s.logProgress(stopProgress)
+	var timeout <-chan time.Time
+	if s.cfg.Timeout > 0 {
+		timeout = time.After(s.cfg.Timeout)
+	}
+	select {
+	case <-s.serveDone:
+	case <-ctx.Done():
+	case <-timeout:
+		log.Printf("INFO [fs-sync-server] Timeout of %s reached, shutting down", s.cfg.Timeout)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	return server.Shutdown(ctx)
+	return server.Shutdown(shutdownCtx)
 }
 
 func (s *Server) handleMode(w http.ResponseWriter, r *http.Request) {
@@ -96,7 +205,43 @@ func (s *Server) handleMode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ModeResponse{Mode: s.cfg.Mode})
+	json.NewEncoder(w).Encode(ModeResponse{
+		Mode:        s.cfg.Mode,
+		Auth:        s.verifier != nil,
+		Compression: []string{encodingGzip},
+	})
+}
+
+// handlePair redeems the pairing code for a session. Each code works once;
+// while the server has room for more clients it logs a fresh code for the
+// next one.
+func (s *Server) handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || s.verifier == nil {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := s.verifier.pair(r)
+	if !ok {
+		log.Printf("WARN [fs-sync-server] Rejected pairing from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log.Printf("INFO [fs-sync-server] Paired client %s", r.RemoteAddr)
+	s.mu.Lock()
+	s.paired++
+	limit := s.clientLimit()
+	more := limit == 0 || s.paired < limit
+	s.mu.Unlock()
+	if more {
+		if code, err := GeneratePairingCode(); err != nil {
+			log.Printf("WARN [fs-sync-server] Failed to generate the next pairing code: %v", err)
+		} else {
+			s.verifier.setCode(code)
+			log.Printf("INFO [fs-sync-server] Pairing code for the next client: %s", code)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PairResponse{Session: id})
 }
 
 func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
@@ -104,136 +249,544 @@ func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	manifest, err := BuildManifest(s.cfg.SyncDir, s.ignorer)
+	// A session starts with the client's manifest request, so time it from
+	// here rather than from when a watching server last finished.
+	report := s.session(r).report
+	report.mu.Lock()
+	report.StartedAt = time.Now()
+	report.mu.Unlock()
+	sub := r.URL.Query().Get("path")
+	if sub != "" && !s.checkSubPath(w, sub) {
+		return
+	}
+	manifest, err := BuildManifestMeta(s.cfg.SyncDir, s.ignorer, s.cache)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.filter.apply(manifest)
+	if sub != "" {
+		manifest = scopeManifest(manifest, sub)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ManifestResponse{Files: manifest})
+	json.NewEncoder(w).Encode(manifest)
 }
 
-func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// checkSubPath validates the sub-path a client scoped its manifest request
+// to. A server that only sends must already hold it; a receiving server
+// creates it as files arrive.
+func (s *Server) checkSubPath(w http.ResponseWriter, sub string) bool {
+	fullPath, err := resolveSyncPath(s.cfg.SyncDir, sub)
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Invalid path: %s", sub)
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return false
+	}
+	if s.ignorer.IsIgnored(sub) || s.ignorer.Match(sub, true) {
+		http.Error(w, "path is ignored", http.StatusForbidden)
+		return false
+	}
+	info, err := os.Stat(fullPath)
+	switch {
+	case os.IsNotExist(err) && !s.receives():
+		http.Error(w, "path not found", http.StatusNotFound)
+		return false
+	case err == nil && !info.IsDir():
+		http.Error(w, "path is not a directory", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// handleFile streams a single file: GET reads from a send-mode server, PUT
+// writes to a receive-mode server and HEAD reports how much of an interrupted
+// upload it already holds. Bodies are raw bytes so memory use does not grow
+// with file size.
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && s.sends():
+		s.sendFile(w, r)
+	case r.Method == http.MethodHead && s.receives():
+		s.reportOffset(w, r)
+	case r.Method == http.MethodPut && s.receives():
+		s.receiveFile(w, r)
+	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) sendFile(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	path := r.URL.Query().Get("path")
+	if s.ignorer.IsIgnored(path) {
+		sess.report.skipped(path)
+		http.Error(w, "path is ignored", http.StatusForbidden)
 		return
 	}
-	var req FileRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	fullPath, err := resolveSyncPath(s.cfg.SyncDir, path)
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Invalid path: %s", path)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var files []FileContent
-	for _, path := range req.Paths {
-		if s.ignorer.IsIgnored(path) {
-			continue
+	if s.filtered(path, fullPath) {
+		sess.report.skipped(path)
+		http.Error(w, "path is filtered", http.StatusForbidden)
+		return
+	}
+	// A symlink is synced as its metadata, never by following it.
+	if target, err := os.Readlink(fullPath); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(FileMeta{Link: target})
+		return
+	}
+	f, err := openRegular(fullPath)
+	if errors.Is(err, errNotRegular) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Failed to read file %s: %v", path, err)
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+	size := info.Size()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	// The client only asks for gzip on files worth compressing. Ranges still
+	// count raw file bytes; the remainder after the offset is what gets
+	// compressed, so the length is unknown up front.
+	gzipped := acceptsGzip(r.Header.Get("Accept-Encoding"))
+	if gzipped {
+		w.Header().Set("Content-Encoding", encodingGzip)
+	}
+	if offset, ok := parseRangeStart(r.Header.Get("Range")); ok {
+		if offset >= size {
+			w.Header().Del("Content-Encoding")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
 		}
-		relPath := filepath.Clean(path)
-		if strings.HasPrefix(relPath, "..") || filepath.IsAbs(relPath) {
-			log.Printf("WARN [fs-sync-server] Invalid path: %s", path)
-			continue
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			http.Error(w, "failed to seek", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		if !gzipped {
+			w.Header().Set("Content-Length", strconv.FormatInt(size-offset, 10))
+		}
+		w.WriteHeader(http.StatusPartialContent)
+	} else if !gzipped {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	var out io.Writer = w
+	if gzipped {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	n, err := io.Copy(countingWriter{w: out, n: &sess.bytes}, f)
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Failed to send %s: %v", path, err)
+		sess.report.failed(path, err)
+		return
+	}
+	sess.files.Add(1)
+	sess.report.sent(path, n)
+}
+
+func (s *Server) receiveFile(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	path := r.URL.Query().Get("path")
+	if s.ignorer.IsIgnored(path) {
+		sess.report.skipped(path)
+		http.Error(w, "path is ignored", http.StatusForbidden)
+		return
+	}
+	fullPath, err := resolveSyncPath(s.cfg.SyncDir, path)
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Invalid path: %s", path)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.filtered(path, fullPath) {
+		sess.report.skipped(path)
+		http.Error(w, "path is filtered", http.StatusForbidden)
+		return
+	}
+	wantHash := r.Header.Get(hashHeader)
+	if wantHash == "" {
+		http.Error(w, errMissingHash.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.cfg.DryRun {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	offset := int64(0)
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		start, _, ok := parseContentRange(contentRange)
+		if !ok {
+			http.Error(w, "invalid Content-Range", http.StatusBadRequest)
+			return
 		}
-		fullPath := filepath.Join(s.cfg.SyncDir, relPath)
-		content, err := os.ReadFile(fullPath)
+		if have := partialOffset(fullPath); start != have {
+			w.Header().Set(offsetHeader, strconv.FormatInt(have, 10))
+			http.Error(w, "upload offset mismatch", http.StatusConflict)
+			return
+		}
+		offset = start
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		log.Printf("ERROR [fs-sync-server] Failed to create directory for %s: %v", path, err)
+		http.Error(w, "failed to create directory", http.StatusInternalServerError)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == encodingGzip {
+		gz, err := gzip.NewReader(r.Body)
 		if err != nil {
-			log.Printf("WARN [fs-sync-server] Failed to read file %s: %v", path, err)
-			continue
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	f, err := openPartial(fullPath, offset)
+	if err != nil {
+		log.Printf("ERROR [fs-sync-server] Failed to write %s: %v", path, err)
+		http.Error(w, "failed to open file", http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(countingWriter{w: f, n: &sess.bytes}, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	report := sess.report
+	report.addBytes(n)
+	if err != nil {
+		// The partial file is kept so a later PUT can resume from its size.
+		log.Printf("ERROR [fs-sync-server] Failed to write %s: %v", path, err)
+		report.failed(path, err)
+		http.Error(w, "failed to write file", http.StatusInternalServerError)
+		return
+	}
+	_, statErr := os.Lstat(fullPath)
+	if err := commitPartial(fullPath, wantHash, sess.trash); err != nil {
+		log.Printf("ERROR [fs-sync-server] Failed to commit %s: %v", path, err)
+		report.failed(path, err)
+		if errors.Is(err, errHashMismatch) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		} else {
+			http.Error(w, "failed to commit file", http.StatusInternalServerError)
 		}
-		files = append(files, FileContent{
-			Path:    path,
-			Content: content,
-		})
+		return
+	}
+	log.Printf("INFO [fs-sync-server] Received: %s", path)
+	sess.received.Add(1)
+	sess.files.Add(1)
+	report.transferred(path, statErr == nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// filtered reports whether the server's filter leaves out its own file at
+// fullPath. Such a file is not part of the sync: it is neither sent nor
+// overwritten. A path the server does not hold yet is not filtered.
+func (s *Server) filtered(path, fullPath string) bool {
+	info, err := os.Lstat(fullPath)
+	return err == nil && info.Mode().IsRegular() && !s.filter.keepFile(path, info)
+}
+
+// handleSignature publishes block checksums of the receive-mode server's copy
+// of a file so the client can send only the blocks that changed.
+func (s *Server) handleSignature(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !s.receives() {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if s.ignorer.IsIgnored(path) {
+		http.Error(w, "path is ignored", http.StatusForbidden)
+		return
+	}
+	fullPath, err := resolveSyncPath(s.cfg.SyncDir, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A file outside the server's filter is not part of the sync, so its
+	// blocks are no more the client's business than its contents.
+	info, err := os.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if !s.filter.keepFile(path, info) {
+		http.Error(w, "path is filtered", http.StatusForbidden)
+		return
+	}
+	sig, err := computeSignature(fullPath)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(FilesResponse{Files: files})
-	s.shutdown()
+	json.NewEncoder(w).Encode(sig)
 }
 
-func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+// handleDelta serves a delta against a posted signature in send mode and
+// applies an uploaded delta in receive mode.
+func (s *Server) handleDelta(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	path := r.URL.Query().Get("path")
+	if s.ignorer.IsIgnored(path) {
+		sess.report.skipped(path)
+		http.Error(w, "path is ignored", http.StatusForbidden)
+		return
+	}
+	fullPath, err := resolveSyncPath(s.cfg.SyncDir, path)
+	if err != nil {
+		log.Printf("WARN [fs-sync-server] Invalid path: %s", path)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.filtered(path, fullPath) {
+		sess.report.skipped(path)
+		http.Error(w, "path is filtered", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && s.sends():
+		var sig Signature
+		if err := json.NewDecoder(r.Body).Decode(&sig); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := openRegular(fullPath)
+		if err != nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := writeDelta(w, f, &sig); err != nil {
+			log.Printf("WARN [fs-sync-server] Failed to send delta for %s: %v", path, err)
+			sess.report.failed(path, err)
+			return
+		}
+		// Progress counts whole files, matching the client's plan.
+		if info, err := f.Stat(); err == nil {
+			sess.bytes.Add(info.Size())
+		}
+		sess.files.Add(1)
+		sess.report.sent(path, 0)
+	case r.Method == http.MethodPut && s.receives():
+		wantHash := r.Header.Get(hashHeader)
+		if wantHash == "" {
+			http.Error(w, errMissingHash.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.cfg.DryRun {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err := applyDeltaToPartial(fullPath, r.Body, wantHash, sess.trash); err != nil {
+			log.Printf("ERROR [fs-sync-server] Failed to apply delta for %s: %v", path, err)
+			sess.report.failed(path, err)
+			if errors.Is(err, errHashMismatch) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			} else {
+				http.Error(w, "failed to apply delta", http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Printf("INFO [fs-sync-server] Received (delta): %s", path)
+		if info, err := os.Stat(fullPath); err == nil {
+			sess.bytes.Add(info.Size())
+		}
+		sess.received.Add(1)
+		sess.files.Add(1)
+		sess.report.transferred(path, true)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) reportOffset(w http.ResponseWriter, r *http.Request) {
+	fullPath, err := resolveSyncPath(s.cfg.SyncDir, r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(offsetHeader, strconv.FormatInt(partialOffset(fullPath), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDone closes a client's session: the receive-mode server applies
+// deletions and prints the summary, and the server shuts down once it has
+// served its last client.
+func (s *Server) handleDone(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	var uploadReq UploadRequest
-	if err := json.NewDecoder(r.Body).Decode(&uploadReq); err != nil {
+	var doneReq DoneRequest
+	if err := json.NewDecoder(r.Body).Decode(&doneReq); err != nil && err != io.EOF {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Each session gets a report and backup session of its own, so clients
+	// syncing at once or one after another in watch mode stay separate.
+	sess, last := s.endSession(r)
+	if s.receives() {
+		s.finishReceive(sess, doneReq)
+	}
+	if s.sends() {
+		sess.report.mu.Lock()
+		sent, bytes := len(sess.report.Sent), sess.report.Bytes
+		sess.report.mu.Unlock()
+		if sent > 0 {
+			log.Printf("INFO [fs-sync-server] %s: %d file(s) sent (%s)", sess.name, sent, formatBytes(bytes))
+		}
+	}
+	if dir, err := sess.trash.close(); err != nil {
+		log.Printf("WARN [fs-sync-server] Failed to record backup session: %v", err)
+	} else if dir != "" {
+		log.Printf("INFO [fs-sync-server] Backup session saved to %s", dir)
+	}
+	sess.report.finish()
+	if s.cfg.OnReport != nil {
+		s.cfg.OnReport(sess.report)
+	}
+	w.WriteHeader(http.StatusOK)
+	if last {
+		s.shutdown()
+	}
+}
 
+func (s *Server) finishReceive(sess *clientSession, doneReq DoneRequest) {
+	report := sess.report
 	if s.cfg.DryRun {
-		for _, file := range uploadReq.Files {
-			log.Printf("INFO [fs-sync-server] Dry Run: %s", file.Path)
+		report.skipped(doneReq.Files...)
+		for _, path := range doneReq.Files {
+			log.Printf("INFO [fs-sync-server] Dry Run: %s", path)
 		}
 		if s.cfg.DeleteExtra {
-			for _, path := range uploadReq.ToDelete {
+			for _, path := range doneReq.ToDelete {
 				log.Printf("INFO [fs-sync-server] Dry Run (delete): %s", path)
 			}
+			report.skipped(doneReq.ToDelete...)
 		}
-		totalCount := len(uploadReq.Files) + len(uploadReq.ToDelete)
+		totalCount := len(doneReq.Files) + len(doneReq.ToDelete)
 		if totalCount == 0 {
 			log.Printf("WARN [fs-sync-server] no files would be synced")
 		} else {
 			log.Printf("INFO [fs-sync-server] %d file(s) would be synced", totalCount)
 		}
-		w.WriteHeader(http.StatusOK)
-		s.shutdown()
 		return
 	}
 
-	count := 0
-	for _, file := range uploadReq.Files {
-		relPath := filepath.Clean(file.Path)
-		if strings.HasPrefix(relPath, "..") || filepath.IsAbs(relPath) {
-			log.Printf("WARN [fs-sync-server] Invalid path: %s", file.Path)
-			continue
-		}
-		fullPath := filepath.Join(s.cfg.SyncDir, relPath)
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-			log.Printf("ERROR [fs-sync-server] Failed to create directory for %s: %v", file.Path, err)
-			continue
-		}
-		if err := os.WriteFile(fullPath, file.Content, 0644); err != nil {
-			log.Printf("ERROR [fs-sync-server] Failed to write %s: %v", file.Path, err)
-			continue
-		}
-		log.Printf("INFO [fs-sync-server] Received: %s", file.Path)
-		count++
-	}
-
+	s.applyReceivedMeta(sess, doneReq)
 	deletedCount := 0
 	if s.cfg.DeleteExtra {
-		for _, path := range uploadReq.ToDelete {
-			relPath := filepath.Clean(path)
-			if strings.HasPrefix(relPath, "..") || filepath.IsAbs(relPath) {
+		for _, path := range doneReq.ToDelete {
+			fullPath, err := resolveSyncPath(s.cfg.SyncDir, path)
+			if err != nil {
 				continue
 			}
-			fullPath := filepath.Join(s.cfg.SyncDir, relPath)
-			if err := os.RemoveAll(fullPath); err != nil {
+			if err := sess.trash.remove(fullPath); err != nil {
 				log.Printf("ERROR [fs-sync-server] Failed to delete %s: %v", path, err)
+				report.failed(path, err)
 			} else {
 				log.Printf("INFO [fs-sync-server] Deleted: %s", path)
+				report.deleted(path)
 				deletedCount++
 			}
 		}
 	}
 
-	totalCount := count + deletedCount
+	if n := len(report.Mismatches); n > 0 {
+		log.Printf("WARN [fs-sync-server] %d file(s) failed checksum verification and were discarded", n)
+	}
+	totalCount := int(sess.received.Load()) + deletedCount
 	if totalCount == 0 {
 		log.Printf("WARN [fs-sync-server] no files were synced")
 	} else {
 		log.Printf("INFO [fs-sync-server] %d file(s) synced", totalCount)
 	}
-	w.WriteHeader(http.StatusOK)
-	s.shutdown()
 }
 
-func (s *Server) getTLSConfig() (*tls.Config, error) {
+// applyReceivedMeta recreates the symlinks named in the session, sets mode
+// and mtime on received paths and creates the client's empty directories.
+func (s *Server) applyReceivedMeta(sess *clientSession, doneReq DoneRequest) {
+	sent := make(map[string]bool, len(doneReq.Files))
+	for _, path := range doneReq.Files {
+		sent[path] = true
+	}
+	report := sess.report
+	for path, meta := range doneReq.Meta {
+		if s.ignorer.IsIgnored(path) {
+			continue
+		}
+		fullPath, err := resolveSyncPath(s.cfg.SyncDir, path)
+		if err != nil {
+			continue
+		}
+		if meta.Link != "" {
+			if !sent[path] {
+				continue
+			}
+			_, statErr := os.Lstat(fullPath)
+			if err := createSymlink(s.cfg.SyncDir, path, meta.Link, sess.trash); err != nil {
+				log.Printf("ERROR [fs-sync-server] Failed to create symlink %s: %v", path, err)
+				report.failed(path, err)
+				continue
+			}
+			log.Printf("INFO [fs-sync-server] Received (symlink): %s", path)
+			sess.received.Add(1)
+			report.transferred(path, statErr == nil)
+			continue
+		}
+		if err := applyMeta(fullPath, meta); err != nil && !os.IsNotExist(err) {
+			log.Printf("WARN [fs-sync-server] Failed to set metadata on %s: %v", path, err)
+		}
+	}
+	for _, dir := range doneReq.Dirs {
+		if s.ignorer.IsIgnored(dir) || s.ignorer.Match(dir, true) {
+			continue
+		}
+		fullPath, err := resolveSyncPath(s.cfg.SyncDir, dir)
+		if err != nil {
+			continue
+		}
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			log.Printf("ERROR [fs-sync-server] Failed to create directory %s: %v", dir, err)
+		}
+	}
+}
+
+// loadCert uses the persistent certificate when configured so its
+// fingerprint survives restarts, and an ephemeral one otherwise.
+func (s *Server) loadCert() (tls.Certificate, error) {
+	if s.cfg.CertFile != "" || s.cfg.KeyFile != "" {
+		if s.cfg.CertFile == "" || s.cfg.KeyFile == "" {
+			return tls.Certificate{}, fmt.Errorf("both a certificate and a key file are required")
+		}
+		return u.LoadOrCreateCert(s.cfg.CertFile, s.cfg.KeyFile)
+	}
 	cert, err := u.GenerateSelfSignedCert()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		return tls.Certificate{}, fmt.Errorf("failed to generate self-signed certificate: %w", err)
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-	}, nil
+	return cert, nil
 }
-
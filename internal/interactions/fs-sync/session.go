@@ -0,0 +1,246 @@
+package fssync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clientHeader identifies a client across its requests, so a server can
+	// track several clients syncing at once.
+	clientHeader = "X-Nits-Client"
+
+	// planHeader carries "<files>/<bytes>" for the transfers a client is
+	// about to make, which the server reports progress against.
+	planHeader = "X-Nits-Plan"
+
+	sessionProgressInterval = 2 * time.Second
+
+	// requestTimeout is how long a client waits on a silent server, and so
+	// also how long a server keeps an idle session for a client that may
+	// have gone away.
+	requestTimeout = 5 * time.Minute
+)
+
+var errSessionExpired = errors.New("client went idle without finishing its sync")
+
+// clientSession is the server's view of one client's sync, from its
+// manifest request to its /done.
+type clientSession struct {
+	name     string
+	report   *SyncReport
+	trash    *Trash
+	received atomic.Int64
+
+	plan     atomic.Pointer[string]
+	files    atomic.Int64
+	bytes    atomic.Int64
+	progress string
+
+	// active counts requests in flight; lastSeen, guarded by Server.mu, is
+	// when the client was last heard from.
+	active   atomic.Int32
+	lastSeen time.Time
+}
+
+// newClientID names a client by its host plus a random suffix, so two
+// clients on one machine are still told apart.
+func newClientID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "client"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// clientTransport tags every request with the client's ID and current plan.
+type clientTransport struct {
+	base http.RoundTripper
+	id   string
+	plan *atomic.Pointer[string]
+}
+
+func (t *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tagged := req.Clone(req.Context())
+	tagged.Header.Set(clientHeader, t.id)
+	if plan := t.plan.Load(); plan != nil {
+		tagged.Header.Set(planHeader, *plan)
+	}
+	return t.base.RoundTrip(tagged)
+}
+
+// session returns the session for the client making r, starting one if
+// needed. Requests without a client ID are grouped by remote address.
+func (s *Server) session(r *http.Request) *clientSession {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	key, name := host, host
+	if id := r.Header.Get(clientHeader); id != "" {
+		key, name = id, fmt.Sprintf("%s (%s)", id, host)
+	}
+	s.mu.Lock()
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = &clientSession{
+			name:   name,
+			report: newSyncReport("server", s.cfg.Mode, s.cfg.DryRun),
+			trash:  newTrash(s.cfg.SyncDir, s.cfg.BackupDir),
+		}
+		s.sessions[key] = sess
+	}
+	sess.lastSeen = time.Now()
+	s.mu.Unlock()
+	// A new plan starts a new transfer phase, such as the push after the
+	// pull of a two-way merge.
+	if plan := r.Header.Get(planHeader); plan != "" {
+		if old := sess.plan.Load(); old == nil || *old != plan {
+			sess.plan.Store(&plan)
+			sess.files.Store(0)
+			sess.bytes.Store(0)
+		}
+	}
+	return sess
+}
+
+// tracked marks the request's session busy while next runs, so a long
+// transfer never looks idle.
+func (s *Server) tracked(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := s.session(r)
+		sess.active.Add(1)
+		defer func() {
+			s.mu.Lock()
+			sess.lastSeen = time.Now()
+			s.mu.Unlock()
+			sess.active.Add(-1)
+		}()
+		next(w, r)
+	}
+}
+
+// expireIdleSessions ends the sessions of clients that have had no request
+// in flight for requestTimeout, as if they had sent /done, so a crashed
+// client does not hold its session until the server exits. An expired
+// client is not counted as served; if it comes back it starts afresh.
+func (s *Server) expireIdleSessions(now time.Time) {
+	s.mu.Lock()
+	var expired []*clientSession
+	for key, sess := range s.sessions {
+		if sess.active.Load() == 0 && now.Sub(sess.lastSeen) > requestTimeout {
+			delete(s.sessions, key)
+			expired = append(expired, sess)
+		}
+	}
+	s.mu.Unlock()
+	for _, sess := range expired {
+		log.Printf("WARN [fs-sync-server] Client %s idle for over %s, ending its session", sess.name, requestTimeout)
+		sess.report.failed("", errSessionExpired)
+		if dir, err := sess.trash.close(); err != nil {
+			log.Printf("WARN [fs-sync-server] Failed to record backup session: %v", err)
+		} else if dir != "" {
+			log.Printf("INFO [fs-sync-server] Backup session saved to %s", dir)
+		}
+		sess.report.finish()
+		if s.cfg.OnReport != nil {
+			s.cfg.OnReport(sess.report)
+		}
+	}
+}
+
+// endSession forgets the client making r and reports whether the server
+// has now served as many clients as it should.
+func (s *Server) endSession(r *http.Request) (*clientSession, bool) {
+	sess := s.session(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, other := range s.sessions {
+		if other == sess {
+			delete(s.sessions, key)
+		}
+	}
+	s.served++
+	limit := s.clientLimit()
+	if limit > 1 {
+		log.Printf("INFO [fs-sync-server] Client %s finished (%d/%d)", sess.name, s.served, limit)
+	}
+	return sess, limit > 0 && s.served >= limit
+}
+
+// clientLimit is how many sessions to serve before exiting; 0 means no
+// limit. Without --max-clients, a server serves one client unless it is
+// watching or bounded by a timeout instead.
+func (s *Server) clientLimit() int {
+	switch {
+	case s.cfg.Watch:
+		return 0
+	case s.cfg.MaxClients > 0:
+		return s.cfg.MaxClients
+	case s.cfg.Timeout > 0:
+		return 0
+	}
+	return 1
+}
+
+// logProgress prints a progress line for each client whose transfers have
+// moved since the last tick, and expires idle sessions, until done is closed.
+func (s *Server) logProgress(done <-chan struct{}) {
+	ticker := time.NewTicker(sessionProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		s.expireIdleSessions(time.Now())
+		s.mu.Lock()
+		var lines []string
+		for _, sess := range s.sessions {
+			if line := sess.progressLine(); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		s.mu.Unlock()
+		sort.Strings(lines)
+		for _, line := range lines {
+			log.Printf("INFO [fs-sync-server] %s", line)
+		}
+	}
+}
+
+// progressLine describes the session's progress against its plan, or is
+// empty when nothing changed since the last call.
+func (sess *clientSession) progressLine() string {
+	plan := sess.plan.Load()
+	if plan == nil {
+		return ""
+	}
+	var planFiles, planBytes int64
+	fmt.Sscanf(*plan, "%d/%d", &planFiles, &planBytes)
+	files, bytes := sess.files.Load(), sess.bytes.Load()
+	percent := int64(100)
+	if planBytes > 0 {
+		percent = min(bytes*100/planBytes, 100)
+	}
+	line := fmt.Sprintf("Progress %s: %d%% (%d/%d file(s), %s)", sess.name, percent, files, planFiles, formatBytes(bytes))
+	if line == sess.progress {
+		return ""
+	}
+	sess.progress = line
+	return line
+}
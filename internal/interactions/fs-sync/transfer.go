@@ -0,0 +1,269 @@
+package fssync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// partialSuffix marks a file that is still being received. It is renamed
+	// into place only once its SHA-256 matches the sender's manifest.
+	partialSuffix = ".nits-partial"
+
+	hashHeader   = "X-Nits-Sha256"
+	offsetHeader = "Upload-Offset"
+)
+
+var (
+	errHashMismatch = errors.New("checksum mismatch")
+	errMissingHash  = errors.New("missing checksum")
+	errNotRegular   = errors.New("not a regular file")
+)
+
+// openRegular opens fullPath for reading only if it is a regular file, so a
+// symlink in its last component is never followed out of the sync root.
+func openRegular(fullPath string) (*os.File, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errNotRegular
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	// The path may have been swapped for a link since the Lstat.
+	if opened, err := f.Stat(); err != nil || !os.SameFile(info, opened) {
+		f.Close()
+		return nil, errNotRegular
+	}
+	return f, nil
+}
+
+func partialPath(fullPath string) string {
+	return fullPath + partialSuffix
+}
+
+// partialOffset returns how many bytes of fullPath have already been received.
+func partialOffset(fullPath string) int64 {
+	info, err := os.Stat(partialPath(fullPath))
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// openPartial opens the partial file for writing at offset, truncating it
+// when offset is zero or when the existing data is shorter than expected.
+func openPartial(fullPath string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(partialPath(fullPath), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() < offset {
+		offset = 0
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// commitPartial verifies the partial file against wantHash, flushes it to
+// disk and renames it over fullPath, so a crash leaves either the old file or
+// the complete new one. The old file is first kept in trash. A mismatching
+// partial is discarded and the existing file is left untouched.
+func commitPartial(fullPath, wantHash string, trash *Trash) error {
+	if wantHash == "" {
+		return errMissingHash
+	}
+	tmpPath := partialPath(fullPath)
+	f, err := os.OpenFile(tmpPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if gotHash := hex.EncodeToString(h.Sum(nil)); gotHash != wantHash {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%w: got %s, want %s", errHashMismatch, gotHash, wantHash)
+	}
+	if err := trash.keep(fullPath); err != nil {
+		return fmt.Errorf("failed to back up previous version: %w", err)
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(fullPath))
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a synced temporary file in
+// the same directory, for state files that must never be left truncated.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes a directory so a rename into it survives a crash. It is
+// best effort: some platforms, notably Windows, cannot sync directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// parseRangeStart parses the open-ended "bytes=N-" form of a Range header,
+// which is the only form the client sends.
+func parseRangeStart(header string) (int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, false
+	}
+	startStr, endStr, ok := strings.Cut(spec, "-")
+	if !ok || endStr != "" {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, false
+	}
+	return start, true
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range header.
+func parseContentRange(header string) (start, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rangeStr, totalStr, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	startStr, _, found := strings.Cut(rangeStr, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	total, err = strconv.ParseInt(totalStr, 10, 64)
+	if err != nil || total < start {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// applyMeta gives fullPath the permission bits and mtime recorded in meta.
+// Symlinks are left alone: their own mode and mtime are not portable.
+func applyMeta(fullPath string, meta FileMeta) error {
+	if meta.Link != "" {
+		return nil
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if meta.Mode != 0 && info.Mode().Perm() != meta.Mode.Perm() {
+		if err := os.Chmod(fullPath, meta.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if meta.ModTime != 0 && info.ModTime().UnixNano() != meta.ModTime {
+		mtime := time.Unix(0, meta.ModTime)
+		if err := os.Chtimes(fullPath, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSymlink points path under root at target, replacing a file or link
+// already there. The link is made under the partial name and renamed into
+// place, after keeping whatever it replaces in trash. Targets that lead
+// outside root are refused.
+func createSymlink(root, path, target string, trash *Trash) error {
+	if err := checkLinkTarget(path, target); err != nil {
+		return err
+	}
+	fullPath, err := resolveSyncPath(root, path)
+	if err != nil {
+		return err
+	}
+	if current, err := os.Readlink(fullPath); err == nil && current == target {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := partialPath(fullPath)
+	os.Remove(tmpPath)
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return err
+	}
+	if err := trash.keep(fullPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to back up previous version: %w", err)
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
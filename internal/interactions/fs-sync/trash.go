@@ -0,0 +1,364 @@
+package fssync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultBackupDir is where deleted and overwritten files are kept,
+	// relative to the sync directory, in one timestamped directory per
+	// session.
+	DefaultBackupDir = ".nits-trash"
+
+	// trashIndexFile records the paths a session created, which restoring
+	// the session removes again.
+	trashIndexFile  = ".nits-session.json"
+	trashTimeFormat = "20060102-150405"
+)
+
+// Trash keeps whatever a sync session deletes or overwrites under
+// <backup dir>/<timestamp> so the session can be rolled back with Restore.
+// A nil Trash deletes and overwrites in place.
+type Trash struct {
+	syncDir string
+	root    string
+	mu      sync.Mutex
+	session string
+	created []string
+}
+
+type trashIndex struct {
+	Created []string `json:"created"`
+}
+
+// RestoreResult lists what Restore put back and what it moved aside.
+type RestoreResult struct {
+	Restored []string
+	Removed  []string
+}
+
+func newTrash(syncDir, backupDir string) *Trash {
+	if backupDir == "" {
+		return nil
+	}
+	return &Trash{syncDir: syncDir, root: backupRoot(syncDir, backupDir)}
+}
+
+// backupRoot resolves a relative backup directory against the sync directory.
+func backupRoot(syncDir, backupDir string) string {
+	if filepath.IsAbs(backupDir) {
+		return filepath.Clean(backupDir)
+	}
+	return filepath.Join(syncDir, backupDir)
+}
+
+// ignoreBackupDir keeps a backup directory inside the sync directory out of
+// the manifest, so old versions are never synced or deleted as extras.
+func ignoreBackupDir(ignorer *PathIgnorer, syncDir, backupDir string) error {
+	if backupDir == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(syncDir, backupRoot(syncDir, backupDir))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	if rel == "." {
+		return errors.New("backup directory cannot be the sync directory")
+	}
+	ignorer.addPattern("/" + filepath.ToSlash(rel) + "/")
+	return nil
+}
+
+// sessionDir creates the session directory on first use, so a sync that
+// changes nothing leaves nothing behind. The caller holds t.mu.
+func (t *Trash) sessionDir() (string, error) {
+	if t.session != "" {
+		return t.session, nil
+	}
+	if err := os.MkdirAll(t.root, 0755); err != nil {
+		return "", err
+	}
+	stamp := time.Now().Format(trashTimeFormat)
+	name := stamp
+	for i := 2; ; i++ {
+		dir := filepath.Join(t.root, name)
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			t.session = dir
+			return dir, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s-%d", stamp, i)
+	}
+}
+
+// target returns where fullPath is kept inside the session, creating its
+// parent directory.
+func (t *Trash) target(fullPath string) (string, error) {
+	rel, err := filepath.Rel(t.syncDir, fullPath)
+	if err != nil {
+		return "", err
+	}
+	dir, err := t.sessionDir()
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// remove moves fullPath into the session instead of deleting it.
+func (t *Trash) remove(fullPath string) error {
+	if t == nil {
+		return os.RemoveAll(fullPath)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+		return nil
+	}
+	dst, err := t.target(fullPath)
+	if err != nil {
+		return err
+	}
+	return movePath(fullPath, dst)
+}
+
+// keep preserves fullPath before it is replaced. Files are hard-linked (or
+// copied) rather than moved, so the replacement can still be renamed over
+// the original atomically. A path that does not exist yet is recorded as
+// created.
+func (t *Trash) keep(fullPath string) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		if rel, err := filepath.Rel(t.syncDir, fullPath); err == nil {
+			t.created = append(t.created, filepath.ToSlash(rel))
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dst, err := t.target(fullPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(fullPath)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case info.IsDir():
+		return movePath(fullPath, dst)
+	}
+	if err := os.Link(fullPath, dst); err == nil {
+		return nil
+	}
+	return copyFile(fullPath, dst, info)
+}
+
+// close writes the session index and returns the session directory, which
+// is empty when the session kept nothing.
+func (t *Trash) close() (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session == "" && len(t.created) == 0 {
+		return "", nil
+	}
+	dir, err := t.sessionDir()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(t.created)
+	data, err := json.Marshal(trashIndex{Created: t.created})
+	if err != nil {
+		return dir, err
+	}
+	return dir, writeFileAtomic(filepath.Join(dir, trashIndexFile), data, 0644)
+}
+
+// movePath renames src to dst. A backup directory may be on another
+// filesystem than the sync directory, where rename fails with EXDEV; then
+// src is copied over and removed instead.
+func movePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return moveByCopy(src, dst)
+}
+
+// moveByCopy copies the file, symlink or directory tree at src to dst and
+// then removes src. A failed copy removes the partial dst and leaves src.
+func moveByCopy(src, dst string) error {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return copyFile(path, target, info)
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyFile(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// TrashSessions lists the sessions kept in backupDir, oldest first.
+func TrashSessions(syncDir, backupDir string) ([]string, error) {
+	entries, err := os.ReadDir(backupRoot(syncDir, backupDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sessions = append(sessions, entry.Name())
+		}
+	}
+	sort.Strings(sessions)
+	return sessions, nil
+}
+
+// Restore rolls a session back: the files it deleted or overwrote are moved
+// back into the sync directory and the files it created are removed. Both
+// go through a new trash session, so a restore can itself be undone.
+func Restore(syncDir, backupDir, session string) (*RestoreResult, error) {
+	absDir, err := filepath.Abs(syncDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve sync directory: %w", err)
+	}
+	if session == "" || strings.ContainsAny(session, `/\`) || session == "." || session == ".." {
+		return nil, fmt.Errorf("invalid session %q", session)
+	}
+	sessionPath := filepath.Join(backupRoot(absDir, backupDir), session)
+	if info, err := os.Stat(sessionPath); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("session not found: %s", session)
+	}
+	var index trashIndex
+	if data, err := os.ReadFile(filepath.Join(sessionPath, trashIndexFile)); err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to read session index: %w", err)
+		}
+	}
+
+	undo := newTrash(absDir, backupDir)
+	result := &RestoreResult{}
+	for _, path := range index.Created {
+		fullPath, err := resolveSyncPath(absDir, path)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+			continue
+		}
+		if err := undo.remove(fullPath); err != nil {
+			return result, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		result.Removed = append(result.Removed, path)
+	}
+	err = filepath.WalkDir(sessionPath, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sessionPath, src)
+		if err != nil || rel == "." || rel == trashIndexFile {
+			return err
+		}
+		dst := filepath.Join(absDir, rel)
+		if d.IsDir() {
+			// Only empty directories need recreating; the rest appear as
+			// their files are moved back.
+			if entries, err := os.ReadDir(src); err == nil && len(entries) == 0 {
+				return os.MkdirAll(dst, 0755)
+			}
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := undo.keep(dst); err != nil {
+			return fmt.Errorf("failed to keep current %s: %w", rel, err)
+		}
+		if err := movePath(src, dst); err != nil {
+			return err
+		}
+		result.Restored = append(result.Restored, filepath.ToSlash(rel))
+		return nil
+	})
+	if _, closeErr := undo.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, os.RemoveAll(sessionPath)
+}
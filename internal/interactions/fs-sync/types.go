@@ -3,78 +3,87 @@ package fssync
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// ManifestResponse lists every synced path with its content hash. Meta holds
+// the mode, mtime and symlink target for each path, and Dirs the directories
+// that would otherwise be lost because they contain nothing to sync.
 type ManifestResponse struct {
-	Files map[string]string `json:"files"`
+	Files map[string]string   `json:"files"`
+	Meta  map[string]FileMeta `json:"meta,omitempty"`
+	Dirs  []string            `json:"dirs,omitempty"`
+	// Filtered lists the files this side holds but its filter left out of
+	// Files, so the other side's --delete leaves them alone.
+	Filtered []string `json:"filtered,omitempty"`
 }
 
-type FileRequest struct {
-	Paths []string `json:"paths"`
-}
-
-type FilesResponse struct {
-	Files []FileContent `json:"files"`
-}
-
-type FileContent struct {
-	Path    string `json:"path"`
-	Content []byte `json:"content"`
+// FileMeta is the metadata the receiver applies after writing a path. For a
+// symlink, Link is its target and the link is recreated instead of transferred.
+type FileMeta struct {
+	Mode    fs.FileMode `json:"mode"`
+	ModTime int64       `json:"mtime"`
+	Size    int64       `json:"size"`
+	Link    string      `json:"link,omitempty"`
 }
 
+// ModeResponse is the handshake: the server's direction, whether it needs a
+// pairing code and which content encodings it accepts and serves.
 type ModeResponse struct {
-	Mode string `json:"mode"`
+	Mode        string   `json:"mode"`
+	Auth        bool     `json:"auth,omitempty"`
+	Compression []string `json:"compression,omitempty"`
 }
 
-type UploadRequest struct {
-	Files    []FileContent `json:"files"`
-	ToDelete []string      `json:"to_delete,omitempty"`
+// PairRequest redeems the pairing code it is signed with. Nonce is the
+// client's half of what the session key is derived from.
+type PairRequest struct {
+	Nonce string `json:"nonce"`
 }
 
-type PathIgnorer struct {
-	patterns []string
+// PairResponse names the session a redeemed code was turned into, the
+// server's half of the session key.
+type PairResponse struct {
+	Session string `json:"session"`
 }
 
-func NewPathIgnorer(ignoreStr string) *PathIgnorer {
-	if ignoreStr == "" {
-		return &PathIgnorer{patterns: []string{}}
-	}
-	parts := strings.Split(ignoreStr, ",")
-	patterns := make([]string, 0, len(parts))
-	for _, part := range parts {
-		trimmed := strings.TrimSpace(part)
-		if trimmed != "" {
-			patterns = append(patterns, trimmed)
-		}
-	}
-	return &PathIgnorer{patterns: patterns}
+// DoneRequest ends a session. File contents travel separately over /file, so
+// Files only names what was (or would be, in a dry run) transferred.
+type DoneRequest struct {
+	Files    []string            `json:"files,omitempty"`
+	ToDelete []string            `json:"to_delete,omitempty"`
+	Meta     map[string]FileMeta `json:"meta,omitempty"`
+	Dirs     []string            `json:"dirs,omitempty"`
 }
 
-func (pi *PathIgnorer) IsIgnored(path string) bool {
-	for _, pattern := range pi.patterns {
-		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
-			return true
-		}
-		if strings.Contains(path, pattern) {
-			return true
-		}
-	}
-	return false
+// BuildManifest hashes every file under rootDir that ignorer does not exclude.
+// It is BuildManifestMeta without the metadata.
+func BuildManifest(rootDir string, ignorer *PathIgnorer, cache *ManifestCache) (map[string]string, error) {
+	manifest, err := BuildManifestMeta(rootDir, ignorer, cache)
+	return manifest.Files, err
 }
 
-func BuildManifest(rootDir string, ignorer *PathIgnorer) (map[string]string, error) {
-	manifest := make(map[string]string)
+// BuildManifestMeta hashes every file under rootDir that ignorer does not
+// exclude, skipping ignored directories entirely, and records each entry's
+// metadata. Symlinks are not followed; their hash covers the target path.
+// When cache is non-nil, files whose size and mtime are unchanged reuse the
+// stored hash, and the cache is saved afterwards on a best-effort basis.
+func BuildManifestMeta(rootDir string, ignorer *PathIgnorer, cache *ManifestCache) (*ManifestResponse, error) {
+	manifest := &ManifestResponse{
+		Files: make(map[string]string),
+		Meta:  make(map[string]FileMeta),
+	}
+	var dirs []string
+	nonEmpty := make(map[string]bool)
 	err := filepath.WalkDir(rootDir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if d.IsDir() {
-			return nil
-		}
 		relPath, err := filepath.Rel(rootDir, path)
 		if err != nil {
 			return err
@@ -83,19 +92,120 @@ func BuildManifest(rootDir string, ignorer *PathIgnorer) (map[string]string, err
 			return nil
 		}
 		relPath = filepath.ToSlash(relPath)
-		if ignorer != nil && ignorer.IsIgnored(relPath) {
+		if d.IsDir() {
+			if ignorer != nil && ignorer.Match(relPath, true) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, relPath)
+			nonEmpty[pathDir(relPath)] = true
+			return nil
+		}
+		if strings.HasSuffix(relPath, partialSuffix) {
+			return nil
+		}
+		if ignorer != nil && ignorer.Match(relPath, false) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		nonEmpty[pathDir(relPath)] = true
+		meta := FileMeta{Mode: info.Mode().Perm(), ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if meta.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+			manifest.Files[relPath] = symlinkHash(meta.Link)
+			manifest.Meta[relPath] = meta
 			return nil
 		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		manifest.Meta[relPath] = meta
+		if cache != nil {
+			if hash, ok := cache.lookup(relPath, info); ok {
+				manifest.Files[relPath] = hash
+				return nil
+			}
+		}
 		hash, err := computeFileHash(path)
 		if err != nil {
 			return err
 		}
-		manifest[relPath] = hash
+		if cache != nil {
+			cache.store(relPath, info, hash)
+		}
+		manifest.Files[relPath] = hash
 		return nil
 	})
+	for _, dir := range dirs {
+		if !nonEmpty[dir] {
+			manifest.Dirs = append(manifest.Dirs, dir)
+		}
+	}
+	if err == nil && cache != nil {
+		cache.prune(manifest.Files)
+		cache.Save()
+	}
 	return manifest, err
 }
 
+// pathDir is the parent of a slash-separated relative path, "." at the root.
+func pathDir(relPath string) string {
+	if i := strings.LastIndex(relPath, "/"); i >= 0 {
+		return relPath[:i]
+	}
+	return "."
+}
+
+// symlinkHash stands in for a content hash so a retargeted link compares as
+// changed; the prefix keeps it distinct from any regular file's hash.
+func symlinkHash(target string) string {
+	sum := sha256.Sum256([]byte("symlink\x00" + target))
+	return hex.EncodeToString(sum[:])
+}
+
+// resolveSyncPath maps a manifest-relative path to an absolute path under root,
+// rejecting anything that escapes it, including through a parent directory
+// that is a symlink. Parents that do not exist yet are created as real
+// directories later.
+func resolveSyncPath(root, path string) (string, error) {
+	relPath := filepath.Clean(filepath.FromSlash(path))
+	if strings.HasPrefix(relPath, "..") || filepath.IsAbs(relPath) || relPath == "." {
+		return "", fmt.Errorf("invalid path: %s", path)
+	}
+	dir := root
+	for part := range strings.SplitSeq(filepath.Dir(relPath), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			break
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("invalid path: %s is under a symlink", path)
+		}
+	}
+	return filepath.Join(root, relPath), nil
+}
+
+// checkLinkTarget rejects a symlink target that is absolute or, resolved from
+// the link's directory, leads outside the sync root.
+func checkLinkTarget(path, target string) error {
+	if filepath.IsAbs(target) || strings.HasPrefix(filepath.ToSlash(target), "/") {
+		return fmt.Errorf("symlink %s points outside the sync directory: %s", path, target)
+	}
+	resolved := filepath.Join(filepath.Dir(filepath.FromSlash(path)), filepath.FromSlash(target))
+	if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("symlink %s points outside the sync directory: %s", path, target)
+	}
+	return nil
+}
+
 func computeFileHash(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
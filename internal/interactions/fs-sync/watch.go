@@ -0,0 +1,142 @@
+package fssync
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// watchDebounce collects a burst of events (an editor save, a build, a
+	// git checkout) into a single sync.
+	watchDebounce = 500 * time.Millisecond
+
+	// watchPollInterval syncs even without local events so changes made on
+	// the server side are picked up too.
+	watchPollInterval = 30 * time.Second
+
+	watchRetryMin = 2 * time.Second
+	watchRetryMax = time.Minute
+)
+
+// Watch syncs once, then keeps syncing whenever the local directory changes
+// (debounced) or the poll interval elapses, until ctx is cancelled. Failed
+// syncs, such as the server being unreachable, are retried with backoff.
+func (c *Client) Watch(ctx context.Context, cb ClientCallbacks) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watcher: %w", err)
+	}
+	defer watcher.Close()
+	if err := c.addWatches(watcher, c.cfg.SyncDir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", c.cfg.SyncDir, err)
+	}
+	cb.info(fmt.Sprintf("Watching %s for changes (Ctrl+C to stop)", c.cfg.SyncDir))
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	retry := watchRetryMin
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !c.watchRelevant(event) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := c.addWatches(watcher, event.Name); err != nil {
+						cb.warn(fmt.Sprintf("Failed to watch %s", event.Name), err)
+					}
+				}
+			}
+			timer.Reset(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			cb.warn("Watcher error", err)
+		case <-timer.C:
+			if err := c.Run(cb); err != nil {
+				cb.warn(fmt.Sprintf("Sync failed, retrying in %s", retry), err)
+				timer.Reset(retry)
+				retry = min(retry*2, watchRetryMax)
+				continue
+			}
+			retry = watchRetryMin
+			// Events queued during the sync may be our own writes or a user
+			// edit the sync missed; they cannot be told apart, so one more
+			// round follows. It writes nothing once in step, which ends the
+			// chain. Directories the sync created are picked up here too.
+			dirty := c.drainEvents(watcher)
+			if err := c.addWatches(watcher, c.cfg.SyncDir); err != nil {
+				cb.warn("Failed to refresh watches", err)
+			}
+			if dirty {
+				timer.Reset(watchDebounce)
+			} else {
+				timer.Reset(watchPollInterval)
+			}
+		}
+	}
+}
+
+// addWatches watches root and every directory below it that is not ignored;
+// fsnotify does not recurse on its own.
+func (c *Client) addWatches(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != c.cfg.SyncDir {
+			relPath, err := filepath.Rel(c.cfg.SyncDir, path)
+			if err != nil || c.ignorer.Match(filepath.ToSlash(relPath), true) {
+				return filepath.SkipDir
+			}
+		}
+		return watcher.Add(path)
+	})
+}
+
+func (c *Client) watchRelevant(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod || strings.HasSuffix(event.Name, partialSuffix) {
+		return false
+	}
+	relPath, err := filepath.Rel(c.cfg.SyncDir, event.Name)
+	if err != nil {
+		return false
+	}
+	return !c.ignorer.IsIgnored(filepath.ToSlash(relPath))
+}
+
+// drainEvents empties the event queue and reports whether any of the events
+// were relevant.
+func (c *Client) drainEvents(watcher *fsnotify.Watcher) bool {
+	dirty := false
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return dirty
+			}
+			if c.watchRelevant(event) {
+				dirty = true
+			}
+		default:
+			return dirty
+		}
+	}
+}
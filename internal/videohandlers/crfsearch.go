@@ -0,0 +1,227 @@
+package videohandlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	sampleSeconds = 8.0
+	sampleCount   = 3
+)
+
+var (
+	vmafScoreRegex = regexp.MustCompile(`VMAF score: ([\d.]+)`)
+	ssimScoreRegex = regexp.MustCompile(`SSIM .*All:([\d.]+)`)
+)
+
+// vmafSSIMPoints maps VMAF targets to roughly equivalent SSIM scores, for
+// when ffmpeg is built without libvmaf.
+var vmafSSIMPoints = [][2]float64{{70, 0.93}, {80, 0.95}, {90, 0.975}, {95, 0.985}, {100, 1}}
+
+type sampleWindow struct {
+	start  float64
+	length float64
+}
+
+// qualityTarget is the metric a CRF search scores against.
+type qualityTarget struct {
+	metric string
+	score  float64
+}
+
+func (q qualityTarget) String() string {
+	if q.metric == "ssim" {
+		return fmt.Sprintf("SSIM %.4f", q.score)
+	}
+	return fmt.Sprintf("VMAF %.2f", q.score)
+}
+
+// crfRange is the range a CRF search covers, from best to worst quality.
+func crfRange(codec string) (int, int) {
+	if codec == "av1" {
+		return 20, 50
+	}
+	return 18, 36
+}
+
+// sampleWindows picks short segments spread across the video; a short video
+// is scored whole.
+func sampleWindows(duration float64) []sampleWindow {
+	if duration <= sampleSeconds*sampleCount*2 {
+		return []sampleWindow{{0, duration}}
+	}
+	windows := make([]sampleWindow, sampleCount)
+	for i := range windows {
+		center := duration * float64(i+1) / float64(sampleCount+1)
+		windows[i] = sampleWindow{center - sampleSeconds/2, sampleSeconds}
+	}
+	return windows
+}
+
+func vmafToSSIM(vmaf float64) float64 {
+	if vmaf <= vmafSSIMPoints[0][0] {
+		return vmafSSIMPoints[0][1]
+	}
+	for i := 1; i < len(vmafSSIMPoints); i++ {
+		lo, hi := vmafSSIMPoints[i-1], vmafSSIMPoints[i]
+		if vmaf <= hi[0] {
+			return lo[1] + (vmaf-lo[0])/(hi[0]-lo[0])*(hi[1]-lo[1])
+		}
+	}
+	return 1
+}
+
+func parseQualityScore(metric, output string) (float64, error) {
+	re := vmafScoreRegex
+	if metric == "ssim" {
+		re = ssimScoreRegex
+	}
+	m := re.FindAllStringSubmatch(output, -1)
+	if len(m) == 0 {
+		return 0, fmt.Errorf("no %s score in ffmpeg output", strings.ToUpper(metric))
+	}
+	return strconv.ParseFloat(m[len(m)-1][1], 64)
+}
+
+// searchCRF finds the highest CRF in [lo, hi] whose score meets target,
+// assuming quality falls as CRF rises. If none does, it returns lo with
+// ok false.
+func searchCRF(lo, hi int, target float64, score func(crf int) (float64, error)) (crf int, best float64, ok bool, err error) {
+	crf, best = lo, -1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		s, err := score(mid)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if s >= target {
+			crf, best, ok = mid, s, true
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	if !ok {
+		if best, err = score(crf); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	return crf, best, ok, nil
+}
+
+// scoreArgs compares dist against ref with the metric's filter; ffmpeg names
+// the VMAF filter libvmaf.
+func scoreArgs(dist, ref, metric string) []string {
+	filter := metric
+	if metric == "vmaf" {
+		filter = "libvmaf"
+	}
+	return []string{"-i", dist, "-i", ref, "-lavfi", "[0:v][1:v]" + filter, "-f", "null", "-"}
+}
+
+func hasLibVMAF(ctx context.Context) bool {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-filters").Output()
+	return err == nil && strings.Contains(string(out), " libvmaf ")
+}
+
+func runFFmpeg(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{"-hide_banner", "-nostdin", "-y"}, args...)
+	out, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return "", fmt.Errorf("ffmpeg failed: %s: %w", lines[len(lines)-1], err)
+	}
+	return string(out), nil
+}
+
+// findCRF encodes samples of the input at several CRFs and returns the
+// highest CRF whose mean score meets the target, with that score. Samples are
+// scaled and tone-mapped like the full encode, so the scores measure only the
+// encoder's loss.
+func findCRF(ctx context.Context, inputFile string, data *FFProbeOutput, opts OptimizeOptions, cb EncodeCallbacks) (int, qualityTarget, error) {
+	target := qualityTarget{metric: "vmaf", score: opts.TargetVMAF}
+	if opts.TargetSSIM > 0 {
+		target = qualityTarget{metric: "ssim", score: opts.TargetSSIM}
+	} else if !hasLibVMAF(ctx) {
+		target = qualityTarget{metric: "ssim", score: vmafToSSIM(opts.TargetVMAF)}
+		cb.info(fmt.Sprintf("ffmpeg has no libvmaf: scoring with SSIM, targeting %.4f for VMAF %.2f", target.score, opts.TargetVMAF))
+	}
+
+	duration, _ := strconv.ParseFloat(data.Format.Duration, 64)
+	if duration <= 0 {
+		return 0, qualityTarget{}, errors.New("cannot search for a CRF: input duration unknown")
+	}
+	videoStreams := filterStreams(data.Streams, "video")
+	if len(videoStreams) == 0 {
+		return 0, qualityTarget{}, fmt.Errorf("no video streams found in input")
+	}
+	filterChain, _, _ := videoFilters(videoStreams[0].stream, opts)
+
+	dir, err := os.MkdirTemp("", "nits-crf-")
+	if err != nil {
+		return 0, qualityTarget{}, fmt.Errorf("failed to create sample directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	windows := sampleWindows(duration)
+	refs := make([]string, len(windows))
+	for i, w := range windows {
+		refs[i] = filepath.Join(dir, fmt.Sprintf("ref-%d.mkv", i))
+		args := []string{"-ss", strconv.FormatFloat(w.start, 'f', 3, 64), "-i", inputFile, "-t", strconv.FormatFloat(w.length, 'f', 3, 64), "-map", "0:v:0"}
+		if len(filterChain) > 0 {
+			args = append(args, "-vf", strings.Join(filterChain, ","))
+		}
+		args = append(args, "-c:v", "ffv1", "-pix_fmt", "yuv420p", "-an", "-sn", refs[i])
+		if _, err := runFFmpeg(ctx, args...); err != nil {
+			return 0, qualityTarget{}, fmt.Errorf("failed to cut sample: %w", err)
+		}
+	}
+	cb.info(fmt.Sprintf("Searching CRF for %s over %d sample(s)", target, len(windows)))
+
+	score := func(crf int) (float64, error) {
+		total := 0.0
+		for i, ref := range refs {
+			dist := filepath.Join(dir, fmt.Sprintf("dist-%d.mkv", i))
+			args := append([]string{"-i", ref}, encoderArgs(opts.Codec, []string{"-crf", strconv.Itoa(crf)}, opts.Preset)...)
+			if _, err := runFFmpeg(ctx, append(args, "-an", dist)...); err != nil {
+				return 0, fmt.Errorf("failed to encode sample at CRF %d: %w", crf, err)
+			}
+			out, err := runFFmpeg(ctx, scoreArgs(dist, ref, target.metric)...)
+			if err != nil {
+				return 0, fmt.Errorf("failed to score sample at CRF %d: %w", crf, err)
+			}
+			s, err := parseQualityScore(target.metric, out)
+			if err != nil {
+				return 0, err
+			}
+			total += s
+		}
+		mean := total / float64(len(refs))
+		cb.info(fmt.Sprintf("CRF %d: %s", crf, qualityTarget{target.metric, mean}))
+		return mean, nil
+	}
+
+	lo, hi := crfRange(opts.Codec)
+	crf, best, ok, err := searchCRF(lo, hi, target.score, score)
+	if err != nil {
+		return 0, qualityTarget{}, err
+	}
+	achieved := qualityTarget{target.metric, best}
+	if !ok {
+		cb.info(fmt.Sprintf("No CRF reaches %s; using CRF %d (%s)", target, crf, achieved))
+	} else {
+		cb.info(fmt.Sprintf("Selected CRF %d (%s)", crf, achieved))
+	}
+	return crf, achieved, nil
+}
@@ -0,0 +1,305 @@
+package videohandlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const DefaultQueueFile = ".nits-video-queue.json"
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobSkipped = "skipped"
+	JobFailed  = "failed"
+)
+
+var videoExtensions = []string{".mp4", ".mkv", ".mov", ".avi", ".m4v", ".webm", ".wmv", ".flv", ".ts", ".mts", ".m2ts", ".mpg", ".mpeg"}
+
+type BatchJob struct {
+	Input       string `json:"input"`
+	Output      string `json:"output,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	InputBytes  int64  `json:"input_bytes,omitempty"`
+	OutputBytes int64  `json:"output_bytes,omitempty"`
+}
+
+// BatchQueue is the persistent state of a batch, saved after every change so
+// an interrupted batch resumes where it left off.
+type BatchQueue struct {
+	path string
+	mu   sync.Mutex
+	Jobs []*BatchJob `json:"jobs"`
+}
+
+type BatchCallbacks struct {
+	OnJobStart func(job *BatchJob, index, total int)
+	OnJobDone  func(job *BatchJob)
+	// Encode receives the per-file encode messages and progress; it is only
+	// used when jobs run one at a time.
+	Encode EncodeCallbacks
+}
+
+func (cb BatchCallbacks) jobStart(job *BatchJob, index, total int) {
+	if cb.OnJobStart != nil {
+		cb.OnJobStart(job, index, total)
+	}
+}
+
+func (cb BatchCallbacks) jobDone(job *BatchJob) {
+	if cb.OnJobDone != nil {
+		cb.OnJobDone(job)
+	}
+}
+
+func IsVideoFile(path string) bool {
+	return slices.Contains(videoExtensions, strings.ToLower(filepath.Ext(path)))
+}
+
+// DiscoverVideos lists the videos in dir, sorted, leaving out earlier
+// .optimized outputs.
+func DiscoverVideos(dir string, recursive bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && (!recursive || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && IsVideoFile(path) && !isOptimizedOutput(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+func isOptimizedOutput(path string) bool {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if strings.HasSuffix(base, ".optimized") {
+		return true
+	}
+	stem, ok := strings.CutSuffix(base, ".optimized.1")
+	return ok && stem != ""
+}
+
+// LoadBatchQueue loads the queue at path and adds any of files it does not
+// know yet. Jobs left running by an interrupted batch, and failed jobs, are
+// queued again; their partial outputs are removed.
+func LoadBatchQueue(path string, files []string) (*BatchQueue, error) {
+	q := &BatchQueue{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read queue file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, q); err != nil {
+			return nil, fmt.Errorf("failed to parse queue file: %w", err)
+		}
+	}
+	known := make(map[string]bool, len(q.Jobs))
+	for _, job := range q.Jobs {
+		known[job.Input] = true
+		switch job.Status {
+		case JobRunning:
+			if job.Output != "" {
+				os.Remove(job.Output)
+			}
+			fallthrough
+		case JobFailed:
+			job.Status = JobPending
+			job.Error = ""
+		}
+	}
+	for _, file := range files {
+		if !known[file] {
+			q.Jobs = append(q.Jobs, &BatchJob{Input: file, Status: JobPending})
+		}
+	}
+	return q, q.save()
+}
+
+func (q *BatchQueue) Path() string {
+	return q.path
+}
+
+// save writes the queue atomically. The caller holds q.mu or is the only user.
+func (q *BatchQueue) save() error {
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+	return nil
+}
+
+func (q *BatchQueue) update(fn func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn()
+	return q.save()
+}
+
+// Remaining counts the jobs that are not finished.
+func (q *BatchQueue) Remaining() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, job := range q.Jobs {
+		if job.Status != JobDone && job.Status != JobSkipped {
+			n++
+		}
+	}
+	return n
+}
+
+// Remove deletes the queue file once the batch needs no resuming.
+func (q *BatchQueue) Remove() error {
+	err := os.Remove(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RunVideoBatch encodes the pending jobs in q, up to parallel at a time.
+// Inputs that already have an optimized output are skipped. A cancelled
+// batch puts its running jobs back to pending and removes their partial
+// outputs.
+func RunVideoBatch(ctx context.Context, q *BatchQueue, opts OptimizeOptions, parallel int, cb BatchCallbacks) error {
+	parallel = max(parallel, 1)
+	var pending []*BatchJob
+	for _, job := range q.Jobs {
+		if job.Status == JobPending {
+			pending = append(pending, job)
+		}
+	}
+
+	outputs := batchOutputs(q.Jobs, opts.Container)
+
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var saveErr error
+	var saveOnce sync.Once
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := runBatchJob(batchCtx, q, pending[i], outputs[pending[i]], i+1, len(pending), opts, parallel, cb); err != nil {
+					saveOnce.Do(func() {
+						saveErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := range pending {
+		select {
+		case jobs <- i:
+		case <-batchCtx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if saveErr != nil {
+		return saveErr
+	}
+	return ctx.Err()
+}
+
+// batchOutputs maps each job to its output. Inputs that differ only in
+// extension, like clip.mp4 and clip.mkv, would share clip.optimized.mp4, so
+// those keep their source extension instead: clip.mkv.optimized.mp4. All jobs
+// count, not just pending ones, so a resumed batch picks the same names.
+func batchOutputs(jobs []*BatchJob, container string) map[*BatchJob]string {
+	outputs := make(map[*BatchJob]string, len(jobs))
+	users := make(map[string]int, len(jobs))
+	for _, job := range jobs {
+		outputs[job] = OptimizedOutputPath(job.Input, container)
+		// Compared case-insensitively, as the filesystem may be.
+		users[strings.ToLower(outputs[job])]++
+	}
+	for _, job := range jobs {
+		if users[strings.ToLower(outputs[job])] > 1 {
+			outputs[job] = job.Input + ".optimized" + filepath.Ext(outputs[job])
+		}
+	}
+	return outputs
+}
+
+func runBatchJob(ctx context.Context, q *BatchQueue, job *BatchJob, output string, index, total int, opts OptimizeOptions, parallel int, cb BatchCallbacks) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	if _, err := os.Stat(output); err == nil {
+		err := q.update(func() {
+			job.Status = JobSkipped
+			job.Output = output
+		})
+		cb.jobDone(job)
+		return err
+	}
+
+	if err := q.update(func() {
+		job.Status = JobRunning
+		job.Output = output
+	}); err != nil {
+		return err
+	}
+	cb.jobStart(job, index, total)
+
+	var encodeCb EncodeCallbacks
+	if parallel == 1 {
+		encodeCb = cb.Encode
+	}
+	res, err := RunVideoOptimize(ctx, job.Input, opts, encodeCb)
+	if err != nil {
+		os.Remove(output)
+	}
+	if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return q.update(func() { job.Status = JobPending })
+	}
+	updateErr := q.update(func() {
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = JobDone
+		job.InputBytes = res.InputBytes
+		job.OutputBytes = res.OutputBytes
+	})
+	cb.jobDone(job)
+	return updateErr
+}
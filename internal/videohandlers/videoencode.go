@@ -59,6 +59,21 @@ type OptimizeOptions struct {
 	AudioMode string
 	Preset    string
 	ToneMap   string
+	// TargetSize (bytes) or TargetBitrate (video bits per second) replace
+	// CRF with a two-pass encode at a fixed bitrate.
+	TargetSize    int64
+	TargetBitrate int64
+	// TargetVMAF or TargetSSIM pick the highest CRF whose sampled quality
+	// meets the score, instead of using CRF as given.
+	TargetVMAF float64
+	TargetSSIM float64
+	// Container is mp4 (default) or mkv. AudioTracks and SubTracks select
+	// streams by "all", "none" or "lang:eng,jpn"; left empty, one audio
+	// track and every subtitle are kept. Audio chosen by AudioTracks is
+	// copied as-is into MKV and encoded to AAC otherwise.
+	Container   string
+	AudioTracks string
+	SubTracks   string
 }
 
 func DefaultOptimizeOptions() OptimizeOptions {
@@ -87,6 +102,15 @@ type OptimizeResult struct {
 	CRF         int
 	Preset      string
 	TimeTaken   time.Duration
+	// VideoBitrate is set for two-pass encodes; TargetSize when one was asked for.
+	VideoBitrate int64
+	TargetSize   int64
+	// QualityMetric and QualityScore are the sampled score a CRF search chose CRF by.
+	QualityMetric string
+	QualityScore  float64
+	// AudioStreams and SubtitleStreams count the streams kept in the output.
+	AudioStreams    int
+	SubtitleStreams int
 }
 
 type indexedStream struct {
@@ -107,15 +131,33 @@ func RunVideoOptimize(ctx context.Context, inputFile string, opts OptimizeOption
 		return nil, err
 	}
 
+	var quality qualityTarget
+	if opts.TargetVMAF > 0 || opts.TargetSSIM > 0 {
+		if opts.TargetSize > 0 || opts.TargetBitrate > 0 {
+			return nil, fmt.Errorf("a quality target cannot be combined with a target size or bitrate")
+		}
+		opts = normalizeOptions(opts)
+		opts.CRF, quality, err = findCRF(ctx, inputFile, data, opts, cb)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	args, outputFile, res, err := buildFFmpegArgs(inputFile, data, opts, cb)
 	if err != nil {
 		return nil, err
 	}
+	res.QualityMetric, res.QualityScore = quality.metric, quality.score
 
 	cb.info(fmt.Sprintf("Command: ffmpeg %s", strings.Join(args, " ")))
 
 	startTime := time.Now()
-	if err := runEncode(ctx, outputFile, data, args, cb); err != nil {
+	if res.VideoBitrate > 0 {
+		err = runTwoPass(ctx, outputFile, data, args, res.Codec, cb)
+	} else {
+		err = runEncode(ctx, filepath.Base(outputFile), data, args, cb)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -135,10 +177,27 @@ func RunVideoOptimize(ctx context.Context, inputFile string, opts OptimizeOption
 	res.DurationSec = durationSec
 	res.TimeTaken = time.Since(startTime)
 
+	if res.TargetSize > 0 {
+		cb.info(fmt.Sprintf("Output %s is %.1f%% of the %s target", FormatSize(float64(outputBytes)), float64(outputBytes)/float64(res.TargetSize)*100, FormatSize(float64(res.TargetSize))))
+	}
+
 	return res, nil
 }
 
-func buildFFmpegArgs(inputFile string, data *FFProbeOutput, opts OptimizeOptions, cb EncodeCallbacks) ([]string, string, *OptimizeResult, error) {
+func runTwoPass(ctx context.Context, outputFile string, data *FFProbeOutput, args []string, codec string, cb EncodeCallbacks) error {
+	statsPrefix, cleanup, err := newStatsPrefix()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	label := filepath.Base(outputFile)
+	if err := runEncode(ctx, label+" (pass 1/2)", data, passArgs(args, codec, 1, statsPrefix), cb); err != nil {
+		return err
+	}
+	return runEncode(ctx, label+" (pass 2/2)", data, passArgs(args, codec, 2, statsPrefix), cb)
+}
+
+func normalizeOptions(opts OptimizeOptions) OptimizeOptions {
 	codec := strings.ToLower(opts.Codec)
 	if codec != "av1" {
 		codec = "hevc"
@@ -177,6 +236,15 @@ func buildFFmpegArgs(inputFile string, data *FFProbeOutput, opts OptimizeOptions
 	if opts.ToneMap == "" {
 		opts.ToneMap = "auto"
 	}
+	if opts.Container = strings.ToLower(opts.Container); opts.Container != "mkv" {
+		opts.Container = "mp4"
+	}
+	return opts
+}
+
+func buildFFmpegArgs(inputFile string, data *FFProbeOutput, opts OptimizeOptions, cb EncodeCallbacks) ([]string, string, *OptimizeResult, error) {
+	opts = normalizeOptions(opts)
+	codec := opts.Codec
 
 	args := []string{"-i", inputFile}
 
@@ -191,34 +259,13 @@ func buildFFmpegArgs(inputFile string, data *FFProbeOutput, opts OptimizeOptions
 
 	args = append(args, "-map", "0:v:0")
 
-	var filterChain []string
-	scaled := false
-	maxW, maxH := 0, 0
-
-	switch opts.MaxRes {
-	case "720p":
-		maxW, maxH = 1280, 720
-	case "480p":
-		maxW, maxH = 854, 480
-	case "none":
-		maxW, maxH = 0, 0
-	default:
-		maxW, maxH = 1920, 1080
-	}
-
-	if maxW > 0 && (origWidth > maxW || origHeight > maxH) {
-		filterChain = append(filterChain, fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease,scale=trunc(iw/2)*2:trunc(ih/2)*2", maxW, maxH))
-		scaled = true
+	filterChain, scaled, toneMapped := videoFilters(primaryVideo, opts)
+	if scaled {
 		cb.info(fmt.Sprintf("Resolution: %dx%d downscaled to fit %s max", origWidth, origHeight, opts.MaxRes))
 	} else {
 		cb.info(fmt.Sprintf("Resolution: %dx%d (retained)", origWidth, origHeight))
 	}
-
-	isHDR := IsHDRStream(primaryVideo)
-	toneMapped := false
-	if opts.ToneMap == "yes" || (opts.ToneMap == "auto" && isHDR) {
-		filterChain = append(filterChain, "format=gbrpf32le", "tonemap=hable:desat=0.5", "format=yuv420p")
-		toneMapped = true
+	if toneMapped {
 		cb.info("HDR detected: applying Hable tone-mapping to standard 8-bit SDR")
 	}
 
@@ -227,61 +274,101 @@ func buildFFmpegArgs(inputFile string, data *FFProbeOutput, opts OptimizeOptions
 		videoFlags = append(videoFlags, "-vf", strings.Join(filterChain, ","))
 	}
 
+	videoBitrate, err := targetVideoBitrate(data, opts)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	rateFlags := []string{"-crf", strconv.Itoa(opts.CRF)}
+	rateDesc := fmt.Sprintf("CRF %d", opts.CRF)
+	if videoBitrate > 0 {
+		rateFlags = []string{"-b:v", strconv.FormatInt(videoBitrate, 10)}
+		rateDesc = fmt.Sprintf("two-pass %s", FormatBitrate(float64(videoBitrate)))
+	}
+
+	videoFlags = append(videoFlags, encoderArgs(codec, rateFlags, opts.Preset)...)
 	if codec == "av1" {
-		videoFlags = append(videoFlags, "-c:v", "libsvtav1", "-crf", strconv.Itoa(opts.CRF), "-preset", opts.Preset, "-svtav1-params", "tune=0", "-pix_fmt", "yuv420p", "-fps_mode", "cfr")
-		cb.info(fmt.Sprintf("Video: AV1 (libsvtav1) CRF %d (preset %s, 8-bit yuv420p, CFR)", opts.CRF, opts.Preset))
+		cb.info(fmt.Sprintf("Video: AV1 (libsvtav1) %s (preset %s, 8-bit yuv420p, CFR)", rateDesc, opts.Preset))
 	} else {
-		videoFlags = append(videoFlags, "-c:v", "libx265", "-crf", strconv.Itoa(opts.CRF), "-preset", opts.Preset, "-pix_fmt", "yuv420p", "-fps_mode", "cfr")
-		cb.info(fmt.Sprintf("Video: H.265 (libx265) CRF %d (preset %s, 8-bit yuv420p, CFR)", opts.CRF, opts.Preset))
+		cb.info(fmt.Sprintf("Video: H.265 (libx265) %s (preset %s, 8-bit yuv420p, CFR)", rateDesc, opts.Preset))
 	}
 
 	var audioFlags []string
-	audioStreams := filterStreams(data.Streams, "audio")
-
-	if opts.AudioMode == "none" || len(audioStreams) == 0 {
+	keptAudio, fellBack, err := selectAudioTracks(data, opts)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if fellBack {
+		cb.info(fmt.Sprintf("Audio: no stream matches %s; keeping the default track", opts.AudioTracks))
+	}
+	if len(keptAudio) == 0 {
 		audioFlags = append(audioFlags, "-an")
 		cb.info("Audio: none")
 	} else {
-		selectedIdx := selectAudioStream(audioStreams)
-		args = append(args, "-map", fmt.Sprintf("0:a:%d", selectedIdx))
-		audioFlags = append(audioFlags, "-c:a", "aac", "-b:a", opts.AudioMode, "-ac", "2", "-ar", "48000")
-
-		selected := audioStreams[selectedIdx]
-		lang := selected.stream.Tags.Language
-		if lang == "" {
-			lang = "und"
-		}
-		if selected.stream.Tags.Title != "" {
-			cb.info(fmt.Sprintf("Audio: stream #%d (%s — %s) → AAC stereo %s 48kHz", selected.stream.Index, lang, selected.stream.Tags.Title, opts.AudioMode))
+		if copiesAudio(opts) {
+			audioFlags = append(audioFlags, "-c:a", "copy")
 		} else {
-			cb.info(fmt.Sprintf("Audio: stream #%d (%s) → AAC stereo %s 48kHz", selected.stream.Index, lang, opts.AudioMode))
+			audioFlags = append(audioFlags, "-c:a", "aac", "-b:a", opts.AudioMode, "-ac", "2", "-ar", "48000")
+		}
+		for i, as := range keptAudio {
+			args = append(args, "-map", fmt.Sprintf("0:a:%d", as.relIdx))
+			audioFlags = append(audioFlags, streamTagArgs("a", i, as.stream)...)
+			if copiesAudio(opts) {
+				cb.info(fmt.Sprintf("Audio: stream %s → copied (%s)", describeStream(as.stream), as.stream.CodecName))
+			} else {
+				cb.info(fmt.Sprintf("Audio: stream %s → AAC stereo %s 48kHz", describeStream(as.stream), opts.AudioMode))
+			}
 		}
 	}
 
 	var subtitleFlags []string
 	subStreams := filterStreams(data.Streams, "subtitle")
-
-	if len(subStreams) > 0 {
-		for i := range subStreams {
-			args = append(args, "-map", fmt.Sprintf("0:s:%d", i))
+	keptSubs := subStreams
+	if opts.SubTracks != "" {
+		if keptSubs, err = matchTracks(subStreams, opts.SubTracks); err != nil {
+			return nil, "", nil, err
 		}
-		subtitleFlags = append(subtitleFlags, "-c:s", "mov_text")
-		cb.info(fmt.Sprintf("Subtitles: %d stream(s) → mov_text", len(subStreams)))
 	}
 
-	dir := filepath.Dir(inputFile)
-	base := strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile))
-	outputFile := filepath.Join(dir, base+".optimized.mp4")
-
-	if outputFile == inputFile || strings.HasSuffix(base, ".optimized") {
-		cleanBase := strings.TrimSuffix(base, ".optimized")
-		outputFile = filepath.Join(dir, cleanBase+".optimized.1.mp4")
+	var droppedImageSubs int
+	outIdx := 0
+	for _, ss := range keptSubs {
+		subCodec := "mov_text"
+		if opts.Container == "mkv" {
+			// Matroska takes every subtitle format as-is except MP4's own.
+			subCodec = "copy"
+			if ss.stream.CodecName == "mov_text" {
+				subCodec = "srt"
+			}
+		} else if isImageSubtitle(ss.stream) {
+			droppedImageSubs++
+			continue
+		}
+		args = append(args, "-map", fmt.Sprintf("0:s:%d", ss.relIdx))
+		subtitleFlags = append(subtitleFlags, fmt.Sprintf("-c:s:%d", outIdx), subCodec)
+		subtitleFlags = append(subtitleFlags, streamTagArgs("s", outIdx, ss.stream)...)
+		outIdx++
+	}
+	if outIdx > 0 {
+		if opts.Container == "mkv" {
+			cb.info(fmt.Sprintf("Subtitles: %d stream(s) → copied", outIdx))
+		} else {
+			cb.info(fmt.Sprintf("Subtitles: %d stream(s) → mov_text", outIdx))
+		}
 	}
+	if droppedImageSubs > 0 {
+		cb.info(fmt.Sprintf("Subtitles: dropped %d image-based stream(s) MP4 cannot hold; use --container mkv to keep them", droppedImageSubs))
+	}
+
+	outputFile := OptimizedOutputPath(inputFile, opts.Container)
 
 	args = append(args, videoFlags...)
 	args = append(args, audioFlags...)
 	args = append(args, subtitleFlags...)
-	args = append(args, "-avoid_negative_ts", "make_zero", "-movflags", "+faststart", outputFile)
+	args = append(args, "-avoid_negative_ts", "make_zero")
+	if opts.Container != "mkv" {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, outputFile)
 
 	targetRes := opts.MaxRes
 	if !scaled {
@@ -289,19 +376,77 @@ func buildFFmpegArgs(inputFile string, data *FFProbeOutput, opts OptimizeOptions
 	}
 
 	return args, outputFile, &OptimizeResult{
-		InputFile:  inputFile,
-		OutputFile: outputFile,
-		OrigWidth:  origWidth,
-		OrigHeight: origHeight,
-		TargetRes:  targetRes,
-		Scaled:     scaled,
-		ToneMapped: toneMapped,
-		Codec:      codec,
-		CRF:        opts.CRF,
-		Preset:     opts.Preset,
+		InputFile:       inputFile,
+		OutputFile:      outputFile,
+		OrigWidth:       origWidth,
+		OrigHeight:      origHeight,
+		TargetRes:       targetRes,
+		Scaled:          scaled,
+		ToneMapped:      toneMapped,
+		Codec:           codec,
+		CRF:             opts.CRF,
+		Preset:          opts.Preset,
+		VideoBitrate:    videoBitrate,
+		TargetSize:      opts.TargetSize,
+		AudioStreams:    len(keptAudio),
+		SubtitleStreams: outIdx,
 	}, nil
 }
 
+func videoFilters(primaryVideo Stream, opts OptimizeOptions) ([]string, bool, bool) {
+	var filterChain []string
+	scaled := false
+	maxW, maxH := 0, 0
+
+	switch opts.MaxRes {
+	case "720p":
+		maxW, maxH = 1280, 720
+	case "480p":
+		maxW, maxH = 854, 480
+	case "none":
+		maxW, maxH = 0, 0
+	default:
+		maxW, maxH = 1920, 1080
+	}
+
+	if maxW > 0 && (primaryVideo.Width > maxW || primaryVideo.Height > maxH) {
+		filterChain = append(filterChain, fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease,scale=trunc(iw/2)*2:trunc(ih/2)*2", maxW, maxH))
+		scaled = true
+	}
+
+	toneMapped := false
+	if opts.ToneMap == "yes" || (opts.ToneMap == "auto" && IsHDRStream(primaryVideo)) {
+		filterChain = append(filterChain, "format=gbrpf32le", "tonemap=hable:desat=0.5", "format=yuv420p")
+		toneMapped = true
+	}
+	return filterChain, scaled, toneMapped
+}
+
+func encoderArgs(codec string, rateFlags []string, preset string) []string {
+	if codec == "av1" {
+		args := append([]string{"-c:v", "libsvtav1"}, rateFlags...)
+		return append(args, "-preset", preset, "-svtav1-params", "tune=0", "-pix_fmt", "yuv420p", "-fps_mode", "cfr")
+	}
+	args := append([]string{"-c:v", "libx265"}, rateFlags...)
+	return append(args, "-preset", preset, "-pix_fmt", "yuv420p", "-fps_mode", "cfr")
+}
+
+func OptimizedOutputPath(inputFile, container string) string {
+	ext := ".mp4"
+	if container == "mkv" {
+		ext = ".mkv"
+	}
+	dir := filepath.Dir(inputFile)
+	base := strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile))
+	outputFile := filepath.Join(dir, base+".optimized"+ext)
+
+	if outputFile == inputFile || strings.HasSuffix(base, ".optimized") {
+		cleanBase := strings.TrimSuffix(base, ".optimized")
+		outputFile = filepath.Join(dir, cleanBase+".optimized.1"+ext)
+	}
+	return outputFile
+}
+
 func filterStreams(streams []Stream, codecType string) []indexedStream {
 	var result []indexedStream
 	for _, s := range streams {
@@ -347,7 +492,7 @@ func isRejectedAudio(s Stream) bool {
 	return false
 }
 
-func runEncode(ctx context.Context, outputFile string, data *FFProbeOutput, ffmpegArgs []string, cb EncodeCallbacks) error {
+func runEncode(ctx context.Context, label string, data *FFProbeOutput, ffmpegArgs []string, cb EncodeCallbacks) error {
 	totalDurationSecs := 0.0
 	if data.Format.Duration != "" {
 		totalDurationSecs, _ = strconv.ParseFloat(data.Format.Duration, 64)
@@ -389,7 +534,6 @@ func runEncode(ctx context.Context, outputFile string, data *FFProbeOutput, ffmp
 		errorChan <- hasErrors
 	}()
 
-	label := filepath.Base(outputFile)
 	var currentPercent atomic.Int64
 	done := make(chan struct{})
 	go func() {
@@ -1,8 +1,14 @@
 package videohandlers
 
 import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -405,3 +411,512 @@ func TestIsErrorLine(t *testing.T) {
 		})
 	}
 }
+
+func writeTestFiles(t *testing.T, root string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiscoverVideos(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root,
+		"ep1.mkv", "ep2.MP4", "ep2.optimized.mp4", "notes.txt",
+		"s02/ep1.mov", ".hidden/ep.mkv",
+	)
+
+	tests := []struct {
+		name      string
+		recursive bool
+		want      []string
+	}{
+		{"top level only", false, []string{"ep1.mkv", "ep2.MP4"}},
+		{"recursive", true, []string{"ep1.mkv", "ep2.MP4", "s02/ep1.mov"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := DiscoverVideos(root, tt.recursive)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range files {
+				rel, _ := filepath.Rel(root, f)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBatchQueueResume(t *testing.T) {
+	root := t.TempDir()
+	queuePath := filepath.Join(root, DefaultQueueFile)
+	files := []string{filepath.Join(root, "a.mkv"), filepath.Join(root, "b.mkv"), filepath.Join(root, "c.mkv")}
+
+	q, err := LoadBatchQueue(queuePath, files[:2])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Simulate a batch killed mid-encode: a done, b running with a partial output.
+	partial := OptimizedOutputPath(files[1], "mp4")
+	writeTestFiles(t, root, filepath.Base(partial))
+	q.Jobs[0].Status = JobDone
+	q.Jobs[1].Status = JobRunning
+	q.Jobs[1].Output = partial
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = LoadBatchQueue(queuePath, files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var statuses []string
+	for _, job := range q.Jobs {
+		statuses = append(statuses, job.Status)
+	}
+	if want := []string{JobDone, JobPending, JobPending}; !slices.Equal(statuses, want) {
+		t.Errorf("got statuses %v, want %v", statuses, want)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("expected partial output removed, stat err = %v", err)
+	}
+	if got := q.Remaining(); got != 2 {
+		t.Errorf("Remaining() = %d, want 2", got)
+	}
+}
+
+func TestRunVideoBatchSkipsExistingOutputs(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, "a.mkv", "a.optimized.mp4", "b.mp4", "b.optimized.mp4")
+	files, err := DiscoverVideos(root, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q, err := LoadBatchQueue(filepath.Join(root, DefaultQueueFile), files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var mu sync.Mutex
+	var done []string
+	cb := BatchCallbacks{OnJobDone: func(job *BatchJob) {
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, job.Status)
+	}}
+	if err := RunVideoBatch(context.Background(), q, DefaultOptimizeOptions(), 2, cb); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(done, []string{JobSkipped, JobSkipped}) {
+		t.Errorf("got job results %v, want both skipped", done)
+	}
+	if q.Remaining() != 0 {
+		t.Errorf("Remaining() = %d, want 0", q.Remaining())
+	}
+}
+
+func TestRunVideoBatchSeparatesSameNamedInputs(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, "clip.mp4", "clip.mkv", "clip.mp4.optimized.mp4", "clip.mkv.optimized.mp4", "other.mkv", "other.optimized.mp4")
+	files, err := DiscoverVideos(root, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("discovered %v, want the three inputs", files)
+	}
+	q, err := LoadBatchQueue(filepath.Join(root, DefaultQueueFile), files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every output exists under its own name, so nothing is encoded.
+	if err := RunVideoBatch(context.Background(), q, DefaultOptimizeOptions(), 2, BatchCallbacks{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := make(map[string]string)
+	for _, job := range q.Jobs {
+		if job.Status != JobSkipped {
+			t.Errorf("%s: status %s, want skipped", job.Input, job.Status)
+		}
+		got[filepath.Base(job.Input)] = filepath.Base(job.Output)
+	}
+	want := map[string]string{"clip.mp4": "clip.mp4.optimized.mp4", "clip.mkv": "clip.mkv.optimized.mp4", "other.mkv": "other.optimized.mp4"}
+	if !maps.Equal(got, want) {
+		t.Errorf("outputs = %v, want %v", got, want)
+	}
+}
+
+func TestParseSizeAndBitrate(t *testing.T) {
+	sizes := map[string]int64{"500MB": 500 << 20, "1.5G": 3 << 29, "700m": 700 << 20, "2048": 2048}
+	for in, want := range sizes {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	rates := map[string]int64{"2500k": 2_500_000, "4M": 4_000_000, "800kbps": 800_000}
+	for in, want := range rates {
+		if got, err := ParseBitrate(in); err != nil || got != want {
+			t.Errorf("ParseBitrate(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "abc", "-5M", "5X"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want error", in)
+		}
+		if _, err := ParseBitrate(in); err == nil {
+			t.Errorf("ParseBitrate(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestBuildFFmpegArgs_TargetSize(t *testing.T) {
+	probe := &FFProbeOutput{
+		Streams: []Stream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080},
+			{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2},
+		},
+		Format: Format{Filename: "talk.mkv", Duration: "1000"},
+	}
+
+	opts := DefaultOptimizeOptions()
+	opts.TargetSize = 100 << 20
+	args, _, res, err := buildFFmpegArgs("/tmp/talk.mkv", probe, opts, EncodeCallbacks{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 100 MiB over 1000s, less 2% overhead and 128k audio.
+	want := int64(822083) - 128000
+	if res.VideoBitrate != want {
+		t.Errorf("got video bitrate %d, want %d", res.VideoBitrate, want)
+	}
+	if slices.Contains(args, "-crf") {
+		t.Errorf("unexpected -crf in target-size args: %v", args)
+	}
+	bIdx := slices.Index(args, "-b:v")
+	if bIdx == -1 || args[bIdx+1] != strconv.FormatInt(want, 10) {
+		t.Errorf("expected -b:v %d, args: %v", want, args)
+	}
+
+	opts.TargetSize = 1 << 20
+	if _, _, _, err := buildFFmpegArgs("/tmp/talk.mkv", probe, opts, EncodeCallbacks{}); err == nil {
+		t.Error("expected error for a target size too small for the duration")
+	}
+	probe.Format.Duration = ""
+	opts.TargetSize = 100 << 20
+	if _, _, _, err := buildFFmpegArgs("/tmp/talk.mkv", probe, opts, EncodeCallbacks{}); err == nil {
+		t.Error("expected error for a target size without a known duration")
+	}
+}
+
+func TestTargetVideoBitrate_MultipleAudioTracks(t *testing.T) {
+	probe := &FFProbeOutput{
+		Streams: []Stream{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "aac", Tags: Tags{Language: "eng"}},
+			{Index: 2, CodecType: "audio", CodecName: "ac3", BitRate: "192000", Tags: Tags{Language: "jpn"}},
+			{Index: 3, CodecType: "audio", CodecName: "dts", Tags: Tags{Language: "fra", BPS: "256000"}},
+		},
+		Format: Format{Duration: "1000"},
+	}
+	total := int64(822083) // 100 MiB over 1000s, less 2% overhead
+
+	tests := []struct {
+		name string
+		opts OptimizeOptions
+		want int64
+	}{
+		{"default keeps one track", OptimizeOptions{AudioMode: "128k"}, total - 128000},
+		{"every track encoded", OptimizeOptions{AudioMode: "128k", AudioTracks: "all"}, total - 3*128000},
+		{"selected tracks encoded", OptimizeOptions{AudioMode: "96k", AudioTracks: "lang:eng,jpn"}, total - 2*96000},
+		// Copied tracks count at their source bitrate; one without a known
+		// bitrate counts at AudioMode.
+		{"tracks copied into mkv", OptimizeOptions{AudioMode: "128k", AudioTracks: "all", Container: "mkv"}, total - 128000 - 192000 - 256000},
+		{"no audio", OptimizeOptions{AudioMode: "none", AudioTracks: "all"}, total},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.TargetSize = 100 << 20
+			got, err := targetVideoBitrate(probe, tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got video bitrate %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPassArgs(t *testing.T) {
+	args := []string{"-i", "in.mkv", "-map", "0:v:0", "-c:v", "libx265", "-b:v", "2000000", "-map", "0:a:0", "-c:a", "aac", "-movflags", "+faststart", "out.mp4"}
+
+	pass1 := passArgs(args, "hevc", 1, "/tmp/stats")
+	if pass1[len(pass1)-1] != os.DevNull || !slices.Contains(pass1, "-an") || slices.Contains(pass1, "-movflags") {
+		t.Errorf("unexpected pass 1 args: %v", pass1)
+	}
+	if !slices.Contains(pass1, "pass=1:stats=/tmp/stats.log") {
+		t.Errorf("expected x265 pass 1 params, got %v", pass1)
+	}
+
+	pass2 := passArgs(args, "hevc", 2, "/tmp/stats")
+	if pass2[len(pass2)-1] != "out.mp4" || !slices.Contains(pass2, "pass=2:stats=/tmp/stats.log") || !slices.Contains(pass2, "-movflags") {
+		t.Errorf("unexpected pass 2 args: %v", pass2)
+	}
+
+	av1 := passArgs(args, "av1", 2, "/tmp/stats")
+	if i := slices.Index(av1, "-pass"); i == -1 || av1[i+1] != "2" || !slices.Contains(av1, "-passlogfile") {
+		t.Errorf("expected -pass 2 -passlogfile for av1, got %v", av1)
+	}
+}
+
+func TestSampleWindows(t *testing.T) {
+	if got := sampleWindows(20); len(got) != 1 || got[0].start != 0 || got[0].length != 20 {
+		t.Errorf("sampleWindows(20) = %v, want the whole clip", got)
+	}
+	got := sampleWindows(400)
+	if len(got) != sampleCount {
+		t.Fatalf("sampleWindows(400) returned %d windows, want %d", len(got), sampleCount)
+	}
+	for i, w := range got {
+		if w.length != sampleSeconds || w.start < 0 || w.start+w.length > 400 {
+			t.Errorf("window %d = %+v out of range", i, w)
+		}
+		if i > 0 && w.start <= got[i-1].start {
+			t.Errorf("windows not in order: %v", got)
+		}
+	}
+}
+
+func TestSearchCRF(t *testing.T) {
+	// Quality falls by one point per CRF step from 100 at CRF 18.
+	var tried []int
+	score := func(crf int) (float64, error) {
+		tried = append(tried, crf)
+		return float64(118 - crf), nil
+	}
+
+	crf, best, ok, err := searchCRF(18, 36, 93, score)
+	if err != nil || !ok || crf != 25 || best != 93 {
+		t.Errorf("searchCRF() = %d, %v, %v, %v; want 25, 93, true", crf, best, ok, err)
+	}
+	if len(tried) > 6 {
+		t.Errorf("searchCRF() scored %d CRFs, want a binary search", len(tried))
+	}
+
+	crf, best, ok, err = searchCRF(18, 36, 101, score)
+	if err != nil || ok || crf != 18 || best != 100 {
+		t.Errorf("unreachable target: searchCRF() = %d, %v, %v, %v; want 18, 100, false", crf, best, ok, err)
+	}
+}
+
+func TestParseQualityScore(t *testing.T) {
+	vmafOut := "[Parsed_libvmaf_0 @ 0x1] VMAF score: 94.512345\n"
+	if got, err := parseQualityScore("vmaf", vmafOut); err != nil || got != 94.512345 {
+		t.Errorf("parseQualityScore(vmaf) = %v, %v", got, err)
+	}
+	ssimOut := "[Parsed_ssim_0 @ 0x1] SSIM Y:0.990 (20.0) U:0.995 (23.0) V:0.994 (22.2) All:0.991727 (20.8)\n"
+	if got, err := parseQualityScore("ssim", ssimOut); err != nil || got != 0.991727 {
+		t.Errorf("parseQualityScore(ssim) = %v, %v", got, err)
+	}
+	if _, err := parseQualityScore("vmaf", "no score here"); err == nil {
+		t.Error("expected error without a score")
+	}
+
+	for metric, want := range map[string]string{"vmaf": "[0:v][1:v]libvmaf", "ssim": "[0:v][1:v]ssim"} {
+		args := scoreArgs("dist.mkv", "ref.mkv", metric)
+		if i := slices.Index(args, "-lavfi"); i == -1 || args[i+1] != want {
+			t.Errorf("scoreArgs(%s) = %v, want -lavfi %s", metric, args, want)
+		}
+	}
+
+	if got := vmafToSSIM(90); got != 0.975 {
+		t.Errorf("vmafToSSIM(90) = %v, want 0.975", got)
+	}
+	if lo, hi := vmafToSSIM(92), vmafToSSIM(94); !(0.975 < lo && lo < hi && hi < 0.985) {
+		t.Errorf("vmafToSSIM not interpolating: 92 -> %v, 94 -> %v", lo, hi)
+	}
+}
+
+func TestLoadVideoProfiles(t *testing.T) {
+	dir := t.TempDir()
+	profiles, err := LoadVideoProfiles(filepath.Join(dir, "missing.yaml"))
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	if got := ProfileNames(profiles); !slices.Equal(got, []string{"archive", "lecture", "phone"}) {
+		t.Errorf("built-in profiles = %v", got)
+	}
+
+	path := filepath.Join(dir, ProfilesFileName)
+	content := `phone:
+  codec: av1
+  max_res: 480p
+  audio: 64k
+anime:
+  crf: 24
+  tone_map: "no"
+  target_vmaf: 95
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err = LoadVideoProfiles(path)
+	if err != nil {
+		t.Fatalf("LoadVideoProfiles: %v", err)
+	}
+	if got := ProfileNames(profiles); !slices.Equal(got, []string{"anime", "archive", "lecture", "phone"}) {
+		t.Errorf("profiles = %v", got)
+	}
+
+	opts := DefaultOptimizeOptions()
+	if err := profiles["phone"].Apply(&opts); err != nil {
+		t.Fatal(err)
+	}
+	// The codec changed without a CRF or preset, so both fall back to the
+	// AV1 defaults.
+	if n := normalizeOptions(opts); n.Codec != "av1" || n.CRF != 32 || n.Preset != "6" || n.MaxRes != "480p" || n.AudioMode != "64k" {
+		t.Errorf("phone options = %+v", n)
+	}
+
+	opts = DefaultOptimizeOptions()
+	if err := profiles["anime"].Apply(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Codec != "hevc" || opts.CRF != 24 || opts.Preset != "medium" || opts.ToneMap != "no" || opts.TargetVMAF != 95 {
+		t.Errorf("anime options = %+v", opts)
+	}
+}
+
+func TestLoadVideoProfiles_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"codec":    "x:\n  codec: vp9\n",
+		"max_res":  "x:\n  max_res: 4k\n",
+		"audio":    "x:\n  audio: loud\n",
+		"tone_map": "x:\n  tone_map: maybe\n",
+		"targets":  "x:\n  target_size: 500MB\n  target_vmaf: 93\n",
+		"crf":      "x:\n  crf: [1]\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ProfilesFileName)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadVideoProfiles(path); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestBuildFFmpegArgs_Tracks(t *testing.T) {
+	probe := &FFProbeOutput{
+		Streams: []Stream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080},
+			{Index: 1, CodecType: "audio", CodecName: "dts", Tags: Tags{Language: "jpn"}},
+			{Index: 2, CodecType: "audio", CodecName: "ac3", Tags: Tags{Language: "eng", Title: "Director's Commentary"}},
+			{Index: 3, CodecType: "audio", CodecName: "ac3", Tags: Tags{Language: "eng"}},
+			{Index: 4, CodecType: "subtitle", CodecName: "subrip", Tags: Tags{Language: "eng", Title: "Full"}},
+			{Index: 5, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle", Tags: Tags{Language: "jpn"}},
+			{Index: 6, CodecType: "subtitle", CodecName: "mov_text"},
+		},
+	}
+	maps := func(args []string) []string {
+		var out []string
+		for i, a := range args {
+			if a == "-map" {
+				out = append(out, args[i+1])
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		opts      OptimizeOptions
+		wantMaps  []string
+		wantFlags []string
+		wantOut   string
+	}{
+		{
+			name:      "default mp4 keeps one audio and text subtitles",
+			opts:      OptimizeOptions{},
+			wantMaps:  []string{"0:v:0", "0:a:2", "0:s:0", "0:s:2"},
+			wantFlags: []string{"-c:a", "aac", "-c:s:0", "mov_text", "-c:s:1", "mov_text"},
+			wantOut:   "/tmp/film.optimized.mp4",
+		},
+		{
+			name:      "mkv keeps every track",
+			opts:      OptimizeOptions{Container: "mkv", AudioTracks: "all", SubTracks: "all"},
+			wantMaps:  []string{"0:v:0", "0:a:0", "0:a:1", "0:a:2", "0:s:0", "0:s:1", "0:s:2"},
+			wantFlags: []string{"-c:a", "copy", "-c:s:0", "copy", "-c:s:1", "copy", "-c:s:2", "srt", "-metadata:s:a:1", "title=Director's Commentary", "-metadata:s:s:1", "language=jpn"},
+			wantOut:   "/tmp/film.optimized.mkv",
+		},
+		{
+			name:      "language selection",
+			opts:      OptimizeOptions{Container: "mkv", AudioTracks: "lang:jpn", SubTracks: "lang:eng,und"},
+			wantMaps:  []string{"0:v:0", "0:a:0", "0:s:0", "0:s:2"},
+			wantFlags: []string{"-c:a", "copy", "-metadata:s:a:0", "language=jpn", "-metadata:s:s:0", "language=eng"},
+			wantOut:   "/tmp/film.optimized.mkv",
+		},
+		{
+			name:      "unmatched audio falls back to the default track",
+			opts:      OptimizeOptions{AudioTracks: "lang:fra", SubTracks: "none"},
+			wantMaps:  []string{"0:v:0", "0:a:2"},
+			wantFlags: []string{"-c:a", "aac"},
+			wantOut:   "/tmp/film.optimized.mp4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, outputFile, res, err := buildFFmpegArgs("/tmp/film.mkv", probe, tt.opts, EncodeCallbacks{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := maps(args); !slices.Equal(got, tt.wantMaps) {
+				t.Errorf("maps = %v, want %v", got, tt.wantMaps)
+			}
+			joined := strings.Join(args, "\x00")
+			for i := 0; i+1 < len(tt.wantFlags); i += 2 {
+				if !strings.Contains(joined, tt.wantFlags[i]+"\x00"+tt.wantFlags[i+1]) {
+					t.Errorf("missing %s %s in %v", tt.wantFlags[i], tt.wantFlags[i+1], args)
+				}
+			}
+			if hasFaststart := slices.Contains(args, "-movflags"); hasFaststart != (tt.opts.Container != "mkv") {
+				t.Errorf("-movflags present = %v for container %q", hasFaststart, tt.opts.Container)
+			}
+			if outputFile != tt.wantOut {
+				t.Errorf("output = %s, want %s", outputFile, tt.wantOut)
+			}
+			if res.AudioStreams+res.SubtitleStreams != len(tt.wantMaps)-1 {
+				t.Errorf("kept %d audio and %d subtitle streams, want %d in total", res.AudioStreams, res.SubtitleStreams, len(tt.wantMaps)-1)
+			}
+		})
+	}
+}
+
+func TestValidateTrackSelection(t *testing.T) {
+	for _, sel := range []string{"all", "none", "lang:eng", "lang:eng, jpn"} {
+		if err := ValidateTrackSelection(sel); err != nil {
+			t.Errorf("%q: %v", sel, err)
+		}
+	}
+	for _, sel := range []string{"", "eng", "lang:", "lang: ,", "some"} {
+		if err := ValidateTrackSelection(sel); err == nil {
+			t.Errorf("%q: expected an error", sel)
+		}
+	}
+}
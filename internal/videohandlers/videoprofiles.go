@@ -0,0 +1,189 @@
+package videohandlers
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+const ProfilesFileName = "video-profiles.yaml"
+
+// VideoProfile is a named set of encode settings. Unset fields keep the
+// defaults (or, for CRF and preset, the codec's defaults).
+type VideoProfile struct {
+	Codec         string  `yaml:"codec,omitempty"`
+	CRF           int     `yaml:"crf,omitempty"`
+	MaxRes        string  `yaml:"max_res,omitempty"`
+	Audio         string  `yaml:"audio,omitempty"`
+	Preset        string  `yaml:"preset,omitempty"`
+	ToneMap       string  `yaml:"tone_map,omitempty"`
+	TargetSize    string  `yaml:"target_size,omitempty"`
+	TargetBitrate string  `yaml:"target_bitrate,omitempty"`
+	TargetVMAF    float64 `yaml:"target_vmaf,omitempty"`
+	TargetSSIM    float64 `yaml:"target_ssim,omitempty"`
+	Container     string  `yaml:"container,omitempty"`
+	AudioTracks   string  `yaml:"audio_tracks,omitempty"`
+	SubTracks     string  `yaml:"subs,omitempty"`
+}
+
+var builtinProfiles = map[string]VideoProfile{
+	"archive": {Codec: "hevc", CRF: 22, MaxRes: "none", Audio: "192k", Preset: "slow", ToneMap: "no"},
+	"phone":   {Codec: "hevc", CRF: 28, MaxRes: "720p", Audio: "96k", Preset: "medium", ToneMap: "yes"},
+	"lecture": {Codec: "av1", CRF: 40, MaxRes: "720p", Audio: "64k", Preset: "8", ToneMap: "auto"},
+}
+
+// ProfilesPath returns ~/.config/nits/video-profiles.yaml.
+func ProfilesPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".config", "nits", ProfilesFileName), nil
+}
+
+// LoadVideoProfiles returns the built-in profiles with those defined in the
+// YAML file at path added; a profile in the file replaces a built-in one of
+// the same name. A missing file is not an error.
+func LoadVideoProfiles(path string) (map[string]VideoProfile, error) {
+	profiles := maps.Clone(builtinProfiles)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file: %w", err)
+	}
+	var custom map[string]VideoProfile
+	if err := yaml.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles file %s: %w", path, err)
+	}
+	for name, p := range custom {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("profile %q in %s: %w", name, path, err)
+		}
+		profiles[strings.ToLower(name)] = p
+	}
+	return profiles, nil
+}
+
+// ProfileNames lists the profiles sorted by name.
+func ProfileNames(profiles map[string]VideoProfile) []string {
+	return slices.Sorted(maps.Keys(profiles))
+}
+
+func (p VideoProfile) validate() error {
+	if p.Codec != "" && p.Codec != "hevc" && p.Codec != "av1" {
+		return fmt.Errorf("codec must be hevc or av1, got %q", p.Codec)
+	}
+	if p.CRF < 0 || p.CRF > 63 {
+		return fmt.Errorf("crf %d out of range", p.CRF)
+	}
+	if p.MaxRes != "" && !slices.Contains([]string{"1080p", "720p", "480p", "none"}, p.MaxRes) {
+		return fmt.Errorf("max_res must be 1080p, 720p, 480p or none, got %q", p.MaxRes)
+	}
+	if p.Audio != "" && p.Audio != "none" {
+		if _, err := ParseBitrate(p.Audio); err != nil {
+			return fmt.Errorf("audio: %w", err)
+		}
+	}
+	if p.ToneMap != "" && !slices.Contains([]string{"auto", "yes", "no"}, p.ToneMap) {
+		return fmt.Errorf("tone_map must be auto, yes or no, got %q", p.ToneMap)
+	}
+	if p.Container != "" && p.Container != "mp4" && p.Container != "mkv" {
+		return fmt.Errorf("container must be mp4 or mkv, got %q", p.Container)
+	}
+	if p.AudioTracks != "" {
+		if err := ValidateTrackSelection(p.AudioTracks); err != nil {
+			return fmt.Errorf("audio_tracks: %w", err)
+		}
+	}
+	if p.SubTracks != "" {
+		if err := ValidateTrackSelection(p.SubTracks); err != nil {
+			return fmt.Errorf("subs: %w", err)
+		}
+	}
+	targets := 0
+	if p.TargetSize != "" {
+		if _, err := ParseSize(p.TargetSize); err != nil {
+			return fmt.Errorf("target_size: %w", err)
+		}
+		targets++
+	}
+	if p.TargetBitrate != "" {
+		if _, err := ParseBitrate(p.TargetBitrate); err != nil {
+			return fmt.Errorf("target_bitrate: %w", err)
+		}
+		targets++
+	}
+	if p.TargetVMAF < 0 || p.TargetVMAF > 100 {
+		return fmt.Errorf("target_vmaf must be between 0 and 100")
+	}
+	if p.TargetSSIM < 0 || p.TargetSSIM > 1 {
+		return fmt.Errorf("target_ssim must be between 0 and 1")
+	}
+	if p.TargetVMAF > 0 {
+		targets++
+	}
+	if p.TargetSSIM > 0 {
+		targets++
+	}
+	if targets > 1 {
+		return fmt.Errorf("only one of target_size, target_bitrate, target_vmaf and target_ssim can be set")
+	}
+	return nil
+}
+
+// Apply sets the profile's fields on opts. Changing the codec resets CRF and
+// preset to that codec's defaults unless the profile sets them too.
+func (p VideoProfile) Apply(opts *OptimizeOptions) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.Codec != "" && p.Codec != opts.Codec {
+		opts.Codec = p.Codec
+		opts.CRF = 0
+		opts.Preset = ""
+	}
+	if p.CRF > 0 {
+		opts.CRF = p.CRF
+	}
+	if p.MaxRes != "" {
+		opts.MaxRes = p.MaxRes
+	}
+	if p.Audio != "" {
+		opts.AudioMode = p.Audio
+	}
+	if p.Preset != "" {
+		opts.Preset = p.Preset
+	}
+	if p.ToneMap != "" {
+		opts.ToneMap = p.ToneMap
+	}
+	if p.Container != "" {
+		opts.Container = p.Container
+	}
+	if p.AudioTracks != "" {
+		opts.AudioTracks = p.AudioTracks
+	}
+	if p.SubTracks != "" {
+		opts.SubTracks = p.SubTracks
+	}
+	// validate has already checked the targets parse.
+	opts.TargetSize, _ = parseOptional(p.TargetSize, ParseSize)
+	opts.TargetBitrate, _ = parseOptional(p.TargetBitrate, ParseBitrate)
+	opts.TargetVMAF = p.TargetVMAF
+	opts.TargetSSIM = p.TargetSSIM
+	return nil
+}
+
+func parseOptional(s string, parse func(string) (int64, error)) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return parse(s)
+}
@@ -0,0 +1,122 @@
+package videohandlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// containerOverhead is the share of a target size left for MP4 muxing
+// overhead when converting it to a bitrate.
+const containerOverhead = 0.02
+
+const minVideoBitrate = 100_000
+
+// ParseSize parses a file size such as "500MB", "1.5G" or "700M", in the
+// same 1024-based units FormatSize prints. A bare number is bytes.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	value, unit := splitUnit(s)
+	multipliers := map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	m, ok := multipliers[unit]
+	v, err := strconv.ParseFloat(value, 64)
+	if !ok || err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(v * m), nil
+}
+
+// ParseBitrate parses a bitrate such as "2500k" or "2.5M" in bits per
+// second, with the 1000-based units ffmpeg uses.
+func ParseBitrate(rate string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(rate)), "BPS")
+	value, unit := splitUnit(s)
+	multipliers := map[string]float64{"": 1, "K": 1e3, "M": 1e6, "G": 1e9}
+	m, ok := multipliers[unit]
+	v, err := strconv.ParseFloat(value, 64)
+	if !ok || err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", rate)
+	}
+	return int64(v * m), nil
+}
+
+func splitUnit(s string) (string, string) {
+	if s != "" && s[len(s)-1] >= 'A' && s[len(s)-1] <= 'Z' {
+		return s[:len(s)-1], s[len(s)-1:]
+	}
+	return s, ""
+}
+
+// audioBitrate is the combined bitrate of the audio tracks an encode keeps.
+// Copied tracks count at their source bitrate where ffprobe knows it.
+func audioBitrate(data *FFProbeOutput, opts OptimizeOptions) int64 {
+	kept, _, err := selectAudioTracks(data, opts)
+	if err != nil {
+		return 0
+	}
+	encoded, _ := ParseBitrate(opts.AudioMode)
+	var total int64
+	for _, as := range kept {
+		if bps := streamBitrate(as.stream); copiesAudio(opts) && bps > 0 {
+			total += bps
+		} else {
+			total += encoded
+		}
+	}
+	return total
+}
+
+// targetVideoBitrate returns the video bitrate for a bitrate-targeted
+// encode, or 0 for a CRF encode. A target size is spread over the duration
+// from ffprobe, less the bitrate of every kept audio track and muxing overhead.
+func targetVideoBitrate(data *FFProbeOutput, opts OptimizeOptions) (int64, error) {
+	if opts.TargetBitrate > 0 {
+		return opts.TargetBitrate, nil
+	}
+	if opts.TargetSize <= 0 {
+		return 0, nil
+	}
+	duration, _ := strconv.ParseFloat(data.Format.Duration, 64)
+	if duration <= 0 {
+		return 0, fmt.Errorf("cannot target a size: input duration unknown")
+	}
+	totalBps := float64(opts.TargetSize) * 8 * (1 - containerOverhead) / duration
+	videoBps := int64(totalBps) - audioBitrate(data, opts)
+	if videoBps < minVideoBitrate {
+		return 0, fmt.Errorf("target size %s is too small for %s of video", FormatSize(float64(opts.TargetSize)), FormatDuration(duration))
+	}
+	return videoBps, nil
+}
+
+// passArgs turns the final encode's arguments into those for one pass of a
+// two-pass encode. The first pass only analyzes video, so it drops audio,
+// subtitles and the output file.
+func passArgs(args []string, codec string, pass int, statsPrefix string) []string {
+	out := slices.Clone(args[:len(args)-1])
+	var passFlags []string
+	if codec == "av1" {
+		passFlags = []string{"-pass", strconv.Itoa(pass), "-passlogfile", statsPrefix}
+	} else {
+		passFlags = []string{"-x265-params", fmt.Sprintf("pass=%d:stats=%s.log", pass, statsPrefix)}
+	}
+	if pass == 2 {
+		out = append(out, passFlags...)
+		return append(out, args[len(args)-1])
+	}
+	if i := slices.Index(out, "-movflags"); i != -1 {
+		out = slices.Delete(out, i, i+2)
+	}
+	out = append(out, passFlags...)
+	return append(out, "-an", "-sn", "-f", "null", os.DevNull)
+}
+
+func newStatsPrefix() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "nits-2pass-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create pass log directory: %w", err)
+	}
+	return filepath.Join(dir, "stats"), func() { os.RemoveAll(dir) }, nil
+}
@@ -0,0 +1,112 @@
+package videohandlers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// imageSubtitleCodecs are bitmap subtitle formats, which MP4 cannot carry.
+var imageSubtitleCodecs = []string{"hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle", "xsub"}
+
+func isImageSubtitle(s Stream) bool {
+	return slices.Contains(imageSubtitleCodecs, s.CodecName)
+}
+
+// ValidateTrackSelection checks an --audio or --subs value: "all", "none",
+// or "lang:" followed by comma-separated language tags.
+func ValidateTrackSelection(sel string) error {
+	_, err := matchTracks(nil, sel)
+	return err
+}
+
+// matchTracks returns the streams a track selection keeps. With lang:, a
+// stream without a language tag matches "und".
+func matchTracks(streams []indexedStream, sel string) ([]indexedStream, error) {
+	switch sel {
+	case "all":
+		return streams, nil
+	case "none":
+		return nil, nil
+	}
+	list, ok := strings.CutPrefix(sel, "lang:")
+	var langs []string
+	for lang := range strings.SplitSeq(list, ",") {
+		if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	if !ok || len(langs) == 0 {
+		return nil, fmt.Errorf("invalid track selection %q: use all, none or lang:eng,jpn", sel)
+	}
+	var matched []indexedStream
+	for _, s := range streams {
+		if slices.Contains(langs, streamLanguage(s.stream)) {
+			matched = append(matched, s)
+		}
+	}
+	return matched, nil
+}
+
+func streamLanguage(s Stream) string {
+	if s.Tags.Language == "" {
+		return "und"
+	}
+	return strings.ToLower(s.Tags.Language)
+}
+
+// selectAudioTracks returns the audio streams an encode keeps. Without a
+// selection it is the one main track; fellBack reports that a language list
+// matched nothing, so the main track was kept instead.
+func selectAudioTracks(data *FFProbeOutput, opts OptimizeOptions) (kept []indexedStream, fellBack bool, err error) {
+	audioStreams := filterStreams(data.Streams, "audio")
+	if opts.AudioMode == "none" || len(audioStreams) == 0 {
+		return nil, false, nil
+	}
+	if opts.AudioTracks != "" {
+		if kept, err = matchTracks(audioStreams, opts.AudioTracks); err != nil || len(kept) > 0 || opts.AudioTracks == "none" {
+			return kept, false, err
+		}
+		fellBack = true
+	}
+	idx := selectAudioStream(audioStreams)
+	return audioStreams[idx : idx+1], fellBack, nil
+}
+
+// copiesAudio reports whether kept audio goes into the output unchanged,
+// which MKV does for tracks picked with AudioTracks.
+func copiesAudio(opts OptimizeOptions) bool {
+	return opts.Container == "mkv" && opts.AudioTracks != ""
+}
+
+// streamBitrate is a stream's bitrate from ffprobe, or from the BPS tag
+// Matroska muxers write; 0 if neither is known.
+func streamBitrate(s Stream) int64 {
+	for _, v := range []string{s.BitRate, s.Tags.BPS} {
+		if bps, err := strconv.ParseInt(v, 10, 64); err == nil && bps > 0 {
+			return bps
+		}
+	}
+	return 0
+}
+
+// streamTagArgs carries a source stream's language and title over to output
+// stream outIdx of the given type ("a" or "s").
+func streamTagArgs(kind string, outIdx int, s Stream) []string {
+	var args []string
+	if s.Tags.Language != "" {
+		args = append(args, fmt.Sprintf("-metadata:s:%s:%d", kind, outIdx), "language="+s.Tags.Language)
+	}
+	if s.Tags.Title != "" {
+		args = append(args, fmt.Sprintf("-metadata:s:%s:%d", kind, outIdx), "title="+s.Tags.Title)
+	}
+	return args
+}
+
+func describeStream(s Stream) string {
+	if s.Tags.Title != "" {
+		return fmt.Sprintf("#%d (%s — %s)", s.Index, streamLanguage(s), s.Tags.Title)
+	}
+	return fmt.Sprintf("#%d (%s)", s.Index, streamLanguage(s))
+}
@@ -4,26 +4,43 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"math/big"
 	"net"
+	"os"
+	"strings"
 	"time"
 )
 
 // GenerateSelfSignedCert creates an in-memory self-signed TLS certificate valid
 // for localhost and loopback addresses, for tools that need ad-hoc HTTPS (e.g. fs-sync).
 func GenerateSelfSignedCert() (tls.Certificate, error) {
+	derBytes, priv, err := generateSelfSigned()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+	}, nil
+}
+
+func generateSelfSigned() ([]byte, *ecdsa.PrivateKey, error) {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("failed to generate private key: %w", err)
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
 
 	template := x509.Certificate{
@@ -43,11 +60,82 @@ func GenerateSelfSignedCert() (tls.Certificate, error) {
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
+	return derBytes, priv, nil
+}
 
-	return tls.Certificate{
-		Certificate: [][]byte{derBytes},
-		PrivateKey:  priv,
-	}, nil
+// LoadOrCreateCert loads a PEM certificate and key from disk, first writing a
+// new self-signed pair there if neither file exists, so the certificate (and
+// its fingerprint) stays stable across runs.
+func LoadOrCreateCert(certFile, keyFile string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		derBytes, priv, err := generateSelfSigned()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyBytes, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to marshal private key: %w", err)
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write key: %w", err)
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write certificate: %w", err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the leaf certificate as
+// colon-separated uppercase hex, the format browsers and openssl display.
+func CertFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// PinnedTLSConfig trusts exactly the certificate with the given SHA-256
+// fingerprint instead of a CA chain. Colons, spaces and case are ignored.
+func PinnedTLSConfig(fingerprint string) *tls.Config {
+	want := normalizeFingerprint(fingerprint)
+	return &tls.Config{
+		// Chain and hostname checks are replaced by the pin below.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			got := hex.EncodeToString(sum[:])
+			if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+				return fmt.Errorf("certificate fingerprint mismatch: got %s", got)
+			}
+			return nil
+		},
+	}
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ':' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(fingerprint))
 }
@@ -1,7 +1,13 @@
 package utils
 
 import (
+	"crypto/tls"
 	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,3 +58,74 @@ func TestGenerateSelfSignedCert(t *testing.T) {
 		t.Error("expected distinct serial numbers across independent calls")
 	}
 }
+
+func TestLoadOrCreateCertStableFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	first, err := LoadOrCreateCert(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCert() create error = %v", err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatalf("expected key file to be written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file permissions = %v, want 0600", info.Mode().Perm())
+	}
+
+	second, err := LoadOrCreateCert(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCert() load error = %v", err)
+	}
+	if CertFingerprint(first) != CertFingerprint(second) {
+		t.Error("fingerprint changed between runs with a persisted certificate")
+	}
+	if fp := CertFingerprint(first); len(fp) != 95 {
+		t.Errorf("unexpected fingerprint format %q", fp)
+	}
+
+	os.Remove(keyFile)
+	if _, err := LoadOrCreateCert(certFile, keyFile); err == nil {
+		t.Error("expected an error when only the certificate file exists")
+	}
+}
+
+func TestPinnedTLSConfig(t *testing.T) {
+	cert, err := GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCert() error = %v", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	other, err := GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCert() error = %v", err)
+	}
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantErr     bool
+	}{
+		{"matching fingerprint", CertFingerprint(cert), false},
+		{"matching fingerprint without colons", strings.ToLower(strings.ReplaceAll(CertFingerprint(cert), ":", "")), false},
+		{"different certificate", CertFingerprint(other), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: PinnedTLSConfig(tt.fingerprint)}}
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GET with pin %q error = %v, wantErr %v", tt.fingerprint, err, tt.wantErr)
+			}
+		})
+	}
+}